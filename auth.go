@@ -0,0 +1,35 @@
+package main
+
+import (
+        "crypto/subtle"
+        "net/http"
+
+        "golang.org/x/crypto/bcrypt"
+)
+
+// requireBasicAuth only serves h to requests carrying the basic_auth
+// credentials. Without basic_auth configured h is returned unchanged.
+func requireBasicAuth(h http.Handler) http.Handler {
+        username := config.BasicAuth.Username
+        if username == "" {
+                return h
+        }
+        hash := []byte(config.BasicAuth.PasswordHash)
+        return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+                user, pass, ok := r.BasicAuth()
+                if !ok || !checkCredentials(username, hash, user, pass) {
+                        w.Header().Set("WWW-Authenticate", `Basic realm="process_scout"`)
+                        http.Error(w, "Unauthorized", http.StatusUnauthorized)
+                        return
+                }
+                h.ServeHTTP(w, r)
+        })
+}
+
+// checkCredentials always runs the bcrypt comparison so a wrong username
+// takes as long to reject as a wrong password.
+func checkCredentials(username string, hash []byte, user, pass string) bool {
+        userOK := subtle.ConstantTimeCompare([]byte(user), []byte(username)) == 1
+        passOK := bcrypt.CompareHashAndPassword(hash, []byte(pass)) == nil
+        return userOK && passOK
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "log/slog"
+        "os/exec"
+        "strings"
+        "sync"
+)
+
+// classifierEntry is a cached external classification. createTime tells a
+// recycled PID apart from the process that was classified.
+type classifierEntry struct {
+        createTime int64
+        ptype      string
+}
+
+var (
+        classifierMu    sync.Mutex
+        classifierCache = map[int32]classifierEntry{}
+)
+
+// externalProcessType asks classifier.command for p's type, invoking it as
+// `command <pid> <name> <cmdline>` and taking the first line of stdout.
+// The result, including the fallback used when the command fails, times out
+// or prints nothing, is cached for the lifetime of the process.
+func externalProcessType(p processInfo, fallback func() string) string {
+        if ptype, ok := cachedProcessType(p); ok {
+                return ptype
+        }
+
+        ptype, err := runClassifier(p)
+        if err != nil {
+                slog.Warn("external classifier failed, using built-in type", "pid", p.pid(), "err", err)
+                ptype = fallback()
+        }
+
+        createTime, _ := p.CreateTime()
+        classifierMu.Lock()
+        classifierCache[p.pid()] = classifierEntry{createTime: createTime, ptype: ptype}
+        classifierMu.Unlock()
+        return ptype
+}
+
+// cachedProcessType returns the external classifier's cached type for p,
+// without running the command on a miss.
+func cachedProcessType(p processInfo) (string, bool) {
+        createTime, _ := p.CreateTime()
+        classifierMu.Lock()
+        entry, ok := classifierCache[p.pid()]
+        classifierMu.Unlock()
+        if ok && entry.createTime == createTime {
+                return entry.ptype, true
+        }
+        return "", false
+}
+
+func runClassifier(p processInfo) (string, error) {
+        name, _ := p.Name()
+        cmdline, _ := p.Cmdline()
+
+        ctx, cancel := context.WithTimeout(context.Background(), config.Classifier.Timeout)
+        defer cancel()
+        out, err := exec.CommandContext(ctx, config.Classifier.Command, fmt.Sprint(p.pid()), name, cmdline).Output()
+        if ctx.Err() != nil {
+                return "", fmt.Errorf("timed out after %s", config.Classifier.Timeout)
+        }
+        if err != nil {
+                return "", err
+        }
+        ptype, _, _ := strings.Cut(string(out), "\n")
+        ptype = strings.TrimSpace(ptype)
+        if ptype == "" {
+                return "", fmt.Errorf("no type printed")
+        }
+        return ptype, nil
+}
+
+// pruneClassifierCache drops entries for PIDs that no longer exist.
+func pruneClassifierCache(live map[int32]bool) {
+        classifierMu.Lock()
+        defer classifierMu.Unlock()
+        for pid := range classifierCache {
+                if !live[pid] {
+                        delete(classifierCache, pid)
+                }
+        }
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+        "encoding/json"
+        "net/http"
+        "os"
+        "sort"
+        "strings"
+        "time"
+)
+
+// classification is how one process would be handled by the next
+// collection, as served on /debug/classify.
+type classification struct {
+        Pid           int32  `json:"pid"`
+        Name          string `json:"name"`
+        Cmdline       string `json:"cmdline"`
+        DetectedType  string `json:"detected_type"`
+        DetectedName  string `json:"detected_name"`
+        MatchedRule   string `json:"matched_rule"`
+        NameSource    string `json:"name_source"`
+        Included      bool   `json:"included"`
+        ExcludeReason string `json:"exclude_reason"`
+}
+
+// classifyHandler runs the classification and filters over every running
+// process and reports the outcome without touching any metric or the
+// per-process history, so it's safe to call while tuning type_rules and
+// name rules. It is only served with debug_classify set. exclude_reason is
+// the process_scout_filtered_total filter that would drop the process,
+// memory_info / cpu_times when it can't be read, or exited when it's gone
+// before it could be classified.
+func classifyHandler(w http.ResponseWriter, r *http.Request) {
+        procs, err := listProcesses()
+        if err != nil {
+                http.Error(w, err.Error(), http.StatusInternalServerError)
+                return
+        }
+
+        collectMu.Lock()
+        includeThreads := config.IncludeThreads
+        collectMu.Unlock()
+        if !includeThreads {
+                procs = threadGroupLeaders(procs)
+        }
+        // read /proc before taking collectMu so a request on a busy host
+        // doesn't hold up collections
+        now := time.Now()
+        snapshots := make([]*procSnapshot, 0, len(procs))
+        for _, p := range procs {
+                snapshots = append(snapshots, readProcSnapshot(p))
+        }
+
+        // config and the CPU history are swapped or updated by collections
+        collectMu.Lock()
+        st := &scrapeState{now: now, selfPid: int32(os.Getpid()), names: make(map[int32]string, len(snapshots))}
+        for _, s := range snapshots {
+                st.names[s.id] = s.name
+        }
+        result := make([]classification, 0, len(snapshots))
+        for _, s := range snapshots {
+                result = append(result, classify(s, st))
+        }
+        collectMu.Unlock()
+
+        sort.Slice(result, func(i, j int) bool { return result[i].Pid < result[j].Pid })
+        w.Header().Set("Content-Type", "application/json")
+        json.NewEncoder(w).Encode(result)
+}
+
+// procSnapshot is everything classify reads from one process, taken up
+// front. It is a filterSubject, so the collection's own classification and
+// filters run on it unchanged.
+type procSnapshot struct {
+        id          int32
+        gone        bool
+        name        string
+        cmdline     []string
+        cmdlineErr  error
+        createTime  int64
+        cgroupData  string
+        username    string
+        usernameErr error
+        ppid        int32
+        ppidErr     error
+        rss         uint64
+        memErr      error
+        cpu         cpuTimeSample
+        lifetimeCPU float64
+        cpuErr      error
+}
+
+func readProcSnapshot(p sourceProcess) *procSnapshot {
+        s := &procSnapshot{id: p.pid()}
+        s.name, _ = p.Name()
+        s.cmdline, s.cmdlineErr = p.CmdlineSlice()
+        cgroup, err := p.readCgroup()
+        if processGone(err) {
+                s.gone = true
+                return s
+        }
+        s.cgroupData = cgroup
+        s.createTime, _ = p.CreateTime()
+        s.username, s.usernameErr = p.Username()
+        s.ppid, s.ppidErr = p.Ppid()
+        if memInfo, err := p.MemoryInfo(); err == nil {
+                s.rss = memInfo.RSS
+        } else {
+                s.memErr = err
+        }
+        times, err := p.Times()
+        if err != nil {
+                s.cpuErr = err
+                return s
+        }
+        s.cpu = cpuTimeSample{createTime: s.createTime, seconds: times.User + times.System, at: time.Now()}
+        s.lifetimeCPU, s.cpuErr = p.CPUPercent()
+        return s
+}
+
+func (s *procSnapshot) Name() (string, error) { return s.name, nil }
+
+func (s *procSnapshot) Cmdline() (string, error) {
+        return strings.Join(s.cmdline, " "), s.cmdlineErr
+}
+
+func (s *procSnapshot) CmdlineSlice() ([]string, error) { return s.cmdline, s.cmdlineErr }
+func (s *procSnapshot) CreateTime() (int64, error)      { return s.createTime, nil }
+func (s *procSnapshot) pid() int32                      { return s.id }
+func (s *procSnapshot) cgroup() string                  { return s.cgroupData }
+func (s *procSnapshot) Username() (string, error)       { return s.username, s.usernameErr }
+func (s *procSnapshot) Ppid() (int32, error)            { return s.ppid, s.ppidErr }
+
+// classify is sampleProcess's classification and filtering on a snapshot.
+// The external classifier isn't run: a process it hasn't classified yet
+// shows its built-in type.
+func classify(s *procSnapshot, st *scrapeState) classification {
+        c := classification{Pid: s.id, Name: s.name}
+        if s.cmdlineErr == nil {
+                c.Cmdline = strings.Join(redactArgs(s.cmdline), " ")
+        }
+        if s.gone {
+                c.ExcludeReason = "exited"
+                return c
+        }
+        switch rule := matchTypeRules(s); {
+        case rule != nil:
+                c.DetectedType = rule.Type
+                c.MatchedRule = "type_rules: " + rule.Pattern
+        case config.Classifier.Command != "":
+                if ptype, ok := cachedProcessType(s); ok {
+                        c.DetectedType = ptype
+                        c.MatchedRule = "classifier"
+                        break
+                }
+                c.DetectedType = builtinProcessType(s)
+                c.MatchedRule = "built-in (not yet run through the classifier)"
+        default:
+                c.DetectedType = builtinProcessType(s)
+                c.MatchedRule = "built-in"
+        }
+        c.DetectedName, c.NameSource = processName(s, c.DetectedType)
+
+        c.ExcludeReason = earlyFilter(s, st)
+        if c.ExcludeReason == "" {
+                c.ExcludeReason = classifiedFilter(s, c.DetectedType, c.DetectedName, st)
+        }
+        if c.ExcludeReason == "" {
+                if s.memErr != nil {
+                        c.ExcludeReason = "memory_info"
+                        return c
+                }
+                if s.cpuErr != nil {
+                        c.ExcludeReason = "cpu_times"
+                        return c
+                }
+                cpuPercent, ok := cpuPercentSincePrev(s.id, s.cpu)
+                if !ok {
+                        cpuPercent = s.lifetimeCPU
+                }
+                memoryMB := float64(s.rss) / (1024 * 1024)
+                if (config.MinMemoryMB > 0 || config.MinCPUPercent > 0) && !aboveThreshold(memoryMB, cpuPercent) {
+                        c.ExcludeReason = "thresholds"
+                }
+        }
+        c.Included = c.ExcludeReason == ""
+        return c
+}
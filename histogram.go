@@ -0,0 +1,115 @@
+package main
+
+import (
+        "sync"
+
+        "github.com/prometheus/client_golang/prometheus"
+)
+
+// histogramCounts is one histogram series computed from a set of values.
+type histogramCounts struct {
+        count  uint64
+        sum    float64
+        counts map[float64]uint64
+}
+
+func countBuckets(buckets, values []float64) histogramCounts {
+        // every bucket must be present, even when empty
+        h := histogramCounts{
+                count:  uint64(len(values)),
+                counts: make(map[float64]uint64, len(buckets)),
+        }
+        for _, upper := range buckets {
+                h.counts[upper] = 0
+        }
+        for _, v := range values {
+                h.sum += v
+                for _, upper := range buckets {
+                        if v <= upper {
+                                h.counts[upper]++
+                        }
+                }
+        }
+        return h
+}
+
+// snapshotHistogram is a histogram rebuilt from scratch on every
+// collection. A regular prometheus.Histogram accumulates forever, which
+// suits events but not "how is the current process table distributed".
+type snapshotHistogram struct {
+        desc    *prometheus.Desc
+        buckets []float64
+
+        mu      sync.Mutex
+        current histogramCounts
+}
+
+func newSnapshotHistogram(name, help string, buckets []float64) *snapshotHistogram {
+        h := &snapshotHistogram{
+                desc:    prometheus.NewDesc(name, help, nil, nil),
+                buckets: buckets,
+        }
+        h.Set(nil)
+        return h
+}
+
+// Set replaces the current distribution with values.
+func (h *snapshotHistogram) Set(values []float64) {
+        current := countBuckets(h.buckets, values)
+
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        h.current = current
+}
+
+func (h *snapshotHistogram) Describe(ch chan<- *prometheus.Desc) {
+        ch <- h.desc
+}
+
+func (h *snapshotHistogram) Collect(ch chan<- prometheus.Metric) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        ch <- prometheus.MustNewConstHistogram(h.desc, h.current.count, h.current.sum, h.current.counts)
+}
+
+// snapshotHistogramVec is a snapshotHistogram with one series per value
+// of a single label. Label values missing from a Set disappear.
+type snapshotHistogramVec struct {
+        desc    *prometheus.Desc
+        buckets []float64
+
+        mu     sync.Mutex
+        series map[string]histogramCounts
+}
+
+func newSnapshotHistogramVec(name, help, label string, buckets []float64) *snapshotHistogramVec {
+        return &snapshotHistogramVec{
+                desc:    prometheus.NewDesc(name, help, []string{label}, nil),
+                buckets: buckets,
+                series:  map[string]histogramCounts{},
+        }
+}
+
+// Set replaces the current distributions with values, keyed by label value.
+func (h *snapshotHistogramVec) Set(values map[string][]float64) {
+        series := make(map[string]histogramCounts, len(values))
+        for label, vs := range values {
+                series[label] = countBuckets(h.buckets, vs)
+        }
+
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        h.series = series
+}
+
+func (h *snapshotHistogramVec) Describe(ch chan<- *prometheus.Desc) {
+        ch <- h.desc
+}
+
+func (h *snapshotHistogramVec) Collect(ch chan<- prometheus.Metric) {
+        h.mu.Lock()
+        defer h.mu.Unlock()
+        for label, s := range h.series {
+                ch <- prometheus.MustNewConstHistogram(h.desc, s.count, s.sum, s.counts, label)
+        }
+}
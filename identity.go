@@ -0,0 +1,56 @@
+package main
+
+// identity is what a process is collected as: its type, name and working
+// directory. These take several /proc reads to work out but rarely change,
+// so they are cached between scrapes.
+type identity struct {
+        createTime int64
+        // executable name when the entry was made; a changed value means
+        // the process exec'd and has to be classified again
+        exe   string
+        ptype string
+        name  string
+        cwd   string
+}
+
+// identityCache is keyed by PID, with createTime telling a recycled PID
+// apart from the process that was cached. It is guarded by stateMu.
+var identityCache = map[int32]identity{}
+
+// processIdentity returns p's cached identity, classifying p on its first
+// scrape, after a PID is reused or after p exec'd another program.
+// Processes whose command line couldn't be read aren't cached, so they get
+// another chance on the next scrape. It fails if p has exited.
+func processIdentity(p sourceProcess) (identity, error) {
+        createTime, _ := p.CreateTime()
+        exe, _ := p.Name()
+        stateMu.Lock()
+        id, ok := identityCache[p.pid()]
+        stateMu.Unlock()
+        if ok && id.createTime == createTime && id.exe == exe {
+                return id, nil
+        }
+        info, err := readSourceCgroup(p)
+        if err != nil {
+                return identity{}, err
+        }
+        id = identity{createTime: createTime, exe: exe}
+        id.ptype = getProcessType(info)
+        id.name = getProcessName(info, id.ptype)
+        id.cwd = getWorkingDirectory(p)
+        if id.name != unreadableName {
+                stateMu.Lock()
+                identityCache[p.pid()] = id
+                stateMu.Unlock()
+        }
+        return id, nil
+}
+
+// pruneIdentityCache drops entries for PIDs that no longer exist.
+func pruneIdentityCache(live map[int32]bool) {
+        for pid := range identityCache {
+                if !live[pid] {
+                        delete(identityCache, pid)
+                }
+        }
+}
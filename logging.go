@@ -0,0 +1,36 @@
+package main
+
+import (
+        "log/slog"
+        "os"
+)
+
+// setupLogging installs the default slog logger for log_level and
+// log_format. quietFlag (-quiet) raises the level to error. It is called
+// again on reload, so both settings can change without a restart.
+func setupLogging(c Config, quietFlag bool) {
+        level := slog.LevelInfo
+        switch c.LogLevel {
+        case "debug":
+                level = slog.LevelDebug
+        case "warn":
+                level = slog.LevelWarn
+        case "error":
+                level = slog.LevelError
+        }
+        if quietFlag {
+                level = slog.LevelError
+        }
+        opts := &slog.HandlerOptions{Level: level}
+        var handler slog.Handler = slog.NewTextHandler(os.Stderr, opts)
+        if c.LogFormat == "json" {
+                handler = slog.NewJSONHandler(os.Stderr, opts)
+        }
+        slog.SetDefault(slog.New(handler))
+}
+
+// fatal logs msg at error level and exits, like log.Fatal.
+func fatal(msg string, args ...any) {
+        slog.Error(msg, args...)
+        os.Exit(1)
+}
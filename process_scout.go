@@ -1,38 +1,353 @@
 package main
 
 import (
+        "bufio"
+        "bytes"
+        "context"
+        "crypto/tls"
+        "encoding/json"
+        "errors"
         "flag"
         "fmt"
-        "log"
+        "io"
+        "log/slog"
+        "math"
+        "net"
         "net/http"
         "os"
+        "os/signal"
         "path/filepath"
+        "regexp"
+        "runtime"
+        "sort"
+        "strconv"
         "strings"
+        "sync"
+        "sync/atomic"
+        "syscall"
+        "time"
+        "unicode/utf8"
 
         "github.com/prometheus/client_golang/prometheus"
+        "github.com/prometheus/client_golang/prometheus/collectors"
         "github.com/prometheus/client_golang/prometheus/promhttp"
+        dto "github.com/prometheus/client_model/go"
+        "github.com/prometheus/common/expfmt"
         "github.com/shirou/gopsutil/v4/cpu"
+        "github.com/shirou/gopsutil/v4/disk"
+        "github.com/shirou/gopsutil/v4/load"
         "github.com/shirou/gopsutil/v4/mem"
+        psnet "github.com/shirou/gopsutil/v4/net"
         "github.com/shirou/gopsutil/v4/process"
+        "golang.org/x/crypto/bcrypt"
         "gopkg.in/yaml.v3"
 )
 
 type Config struct {
-        ListenAddress string   `yaml:"listen_address"`
-        IncludeTypes  []string `yaml:"include_types"`
-        Labels        struct {
+        ListenAddress string `yaml:"listen_address"`
+        MetricsPath   string `yaml:"metrics_path"`
+        // ProcPath is where the host's /proc is mounted (default HOST_PROC
+        // or /proc), e.g. /host/proc in a sidecar container
+        ProcPath     string   `yaml:"proc_path"`
+        LogLevel     string   `yaml:"log_level"`
+        LogFormat    string   `yaml:"log_format"`
+        IncludeTypes []string `yaml:"include_types"`
+        // ExcludeTypes and ExcludeNames (regexes on the process name) drop
+        // processes even when include_types lets them through
+        ExcludeTypes []string `yaml:"exclude_types"`
+        ExcludeNames []string `yaml:"exclude_names"`
+        // IncludeUsers and ExcludeUsers filter by process owner; exclude
+        // wins. UnknownUsers (include or exclude) decides for processes
+        // whose owner can't be looked up.
+        IncludeUsers []string `yaml:"include_users"`
+        ExcludeUsers []string `yaml:"exclude_users"`
+        UnknownUsers string   `yaml:"unknown_users"`
+        WatchNames   []string `yaml:"watch_names"`
+        // CgroupSubtree only keeps processes in this cgroup or below it
+        CgroupSubtree string `yaml:"cgroup_subtree"`
+        // ParentNameFilter only keeps processes whose parent has this name
+        ParentNameFilter string `yaml:"parent_name_filter"`
+        // AggregateChildren reports matched children under a matched
+        // parent with the same name and type as part of that parent
+        AggregateChildren bool `yaml:"aggregate_children"`
+        ExcludeSelf       bool `yaml:"exclude_self"`
+        // IncludeThreads keeps non-leader tasks that some /proc views list
+        // as processes; by default only thread-group leaders are collected
+        IncludeThreads bool   `yaml:"include_threads"`
+        HostLabel      string `yaml:"host_label"`
+        // MetricPrefix is prepended, with an underscore, to every exporter
+        // metric name
+        MetricPrefix string `yaml:"metric_prefix"`
+        // SampleTimestamps stamps per-process samples with the time they
+        // were collected instead of leaving it to the scraper
+        SampleTimestamps bool `yaml:"sample_timestamps"`
+        // NameFromArgs are command-line flags whose value names a process:
+        // "-Dname=" style prefixes, or "--name" followed by the value
+        NameFromArgs []string `yaml:"name_from_args"`
+        NameMaxArgs  int      `yaml:"name_max_args"`
+        // SkipKernelThreads drops processes with an empty command line
+        SkipKernelThreads bool `yaml:"skip_kernel_threads"`
+        // ProcessAgeBuckets are the upper bounds, in seconds, of the
+        // server_process_age_seconds histogram
+        ProcessAgeBuckets []float64 `yaml:"process_age_buckets"`
+        // MemoryHistogramBuckets are the exponential buckets, in MB, of the
+        // process_memory_distribution_mb histogram: Count buckets starting
+        // at Start, each Factor times the previous one
+        MemoryHistogramBuckets struct {
+                Start  float64 `yaml:"start"`
+                Factor float64 `yaml:"factor"`
+                Count  int     `yaml:"count"`
+        } `yaml:"memory_histogram_buckets"`
+        // FDLimitRatio is the open-FDs / soft-limit fraction at which a
+        // process counts towards server_processes_near_fd_limit
+        FDLimitRatio float64 `yaml:"fd_limit_ratio"`
+        // KeepMissingFor retains a process's last values for this many
+        // scrapes after it stops being reported (0 = drop immediately)
+        KeepMissingFor int `yaml:"keep_missing_for"`
+        // LeakDetection flags processes whose RSS grew on each of the last
+        // Samples scrapes at MinGrowthMBPerHour or more (Samples 0 = off)
+        LeakDetection struct {
+                Samples            int     `yaml:"samples"`
+                MinGrowthMBPerHour float64 `yaml:"min_growth_mb_per_hour"`
+        } `yaml:"leak_detection"`
+        // MaxSeries caps distinct per-process label sets per scrape; the
+        // rest are summed into one "(overflow)" series (0 = no cap)
+        MaxSeries int `yaml:"max_series"`
+        // CollectionWorkers is how many processes are sampled in parallel
+        // (default: the number of CPUs; 1 samples them one by one)
+        CollectionWorkers int `yaml:"collection_workers"`
+        // MinMemoryMB and MinCPUPercent skip processes below every set
+        // threshold (0 = no threshold)
+        MinMemoryMB   float64 `yaml:"min_memory_mb"`
+        MinCPUPercent float64 `yaml:"min_cpu_percent"`
+        // TopN exports only the N heaviest processes by TopBy (memory or cpu)
+        TopN  int    `yaml:"top_n"`
+        TopBy string `yaml:"top_by"`
+        // ScrapeInterval is how often metrics are collected in the
+        // background; with CollectOnScrape every /metrics request collects
+        ScrapeInterval  time.Duration `yaml:"scrape_interval"`
+        CollectOnScrape bool          `yaml:"collect_on_scrape"`
+        // MinScrapeInterval is how soon after a collection finishes a
+        // collect_on_scrape request may start another; requests before then
+        // are served the previous results (0 = collect on every request)
+        MinScrapeInterval time.Duration `yaml:"min_scrape_interval"`
+        // HostCPUSampleInterval is how often the background sampler measures
+        // host CPU usage for server_available_cpu_cores
+        HostCPUSampleInterval time.Duration `yaml:"host_cpu_sample_interval"`
+        // CPUSmoothingWindows adds an EWMA-smoothed CPU gauge per window
+        CPUSmoothingWindows []time.Duration `yaml:"cpu_smoothing_windows"`
+        Labels              struct {
                 Cwd         bool `yaml:"cwd"`
                 ProcessName bool `yaml:"process_name"`
                 Type        bool `yaml:"type"`
                 User        bool `yaml:"user"`
+                // docker, containerd, crio or podman; empty outside containers
+                ContainerRuntime bool `yaml:"container_runtime"`
+                // kernel function the process is blocked in; high cardinality
+                Wchan bool `yaml:"wchan"`
+                // controlling terminal (e.g. pts/3); empty for daemons
+                TTY bool `yaml:"tty"`
+                // virtualenv root or interpreter path; python processes only
+                PythonDetails bool `yaml:"python_details"`
+                // name of the parent process, "(none)" if it has exited
+                ParentName bool `yaml:"parent_name"`
+                // full command line, cut to CmdlineMaxLength; high cardinality
+                Cmdline bool `yaml:"cmdline"`
         } `yaml:"labels"`
+        // CmdlineMaxLength is the most bytes of the cmdline label kept
+        CmdlineMaxLength int `yaml:"cmdline_max_length"`
+        // RedactArgs are regexes; matching command-line args have their
+        // value (or, without "=", the whole arg) masked in the cmdline label
+        RedactArgs []string `yaml:"redact_args"`
+        // EnvLabels adds a label per entry, label name -> environment
+        // variable read from the process; empty when unset or unreadable
+        EnvLabels map[string]string `yaml:"env_labels"`
+        // TypeRules classify processes by regex before the built-in rules
+        TypeRules []TypeRule `yaml:"type_rules"`
+        // NameRules extract the process name from the command line, checked
+        // in order before name_from_args
+        NameRules []NameRule `yaml:"name_rules"`
+        // TypeDisplayNames replaces type label values on export, e.g.
+        // java: "Java Application"; classification itself is unchanged
+        TypeDisplayNames map[string]string `yaml:"type_display_names"`
+        FlatLabels       bool              `yaml:"flat_labels"`
+        LabelSeparator   string            `yaml:"label_separator"`
+        // Memory adds a gauge per selected memory kind; process_memory_mb
+        // (RSS) is always exported
+        Memory struct {
+                RSS  bool `yaml:"rss"`
+                VMS  bool `yaml:"vms"`
+                Swap bool `yaml:"swap"`
+        } `yaml:"memory"`
+        Metrics struct {
+                SharedMemory    bool `yaml:"shared_memory"`
+                DiskIO          bool `yaml:"disk_io"`
+                ThreadCPU       bool `yaml:"thread_cpu"`
+                MappedFiles     bool `yaml:"mapped_files"`
+                SchedPolicy     bool `yaml:"sched_policy"`
+                MemoryLimit     bool `yaml:"memory_limit"`
+                RunnableThreads bool `yaml:"runnable_threads"`
+                NearFDLimit     bool `yaml:"near_fd_limit"`
+                ExeDeleted      bool `yaml:"exe_deleted"`
+                NUMAMemory      bool `yaml:"numa_memory"`
+                OpenFDs         bool `yaml:"open_fds"`
+                Threads         bool `yaml:"threads"`
+                StartTime       bool `yaml:"start_time"`
+                PerCPU          bool `yaml:"per_cpu"`
+                Connections     bool `yaml:"connections"`
+                LastSeen        bool `yaml:"last_seen"`
+                PageFaults      bool `yaml:"page_faults"`
+                CmdlineArgCount bool `yaml:"cmdline_arg_count"`
+                ProcessAge      bool `yaml:"process_age"`
+                MemoryHistogram bool `yaml:"memory_histogram"`
+                JVM             bool `yaml:"jvm"`
+        } `yaml:"metrics"`
+        // Classifier delegates type detection to an external program
+        Classifier struct {
+                Command string        `yaml:"command"`
+                Timeout time.Duration `yaml:"timeout"`
+        } `yaml:"classifier"`
+        // BasicAuth protects /metrics; PasswordHash is a bcrypt hash
+        BasicAuth struct {
+                Username     string `yaml:"username"`
+                PasswordHash string `yaml:"password_hash"`
+        } `yaml:"basic_auth"`
+        TLS struct {
+                CertFile string `yaml:"cert_file"`
+                KeyFile  string `yaml:"key_file"`
+        } `yaml:"tls"`
+        RemoteWrite struct {
+                URL      string        `yaml:"url"`
+                Interval time.Duration `yaml:"interval"`
+                Timeout  time.Duration `yaml:"timeout"`
+        } `yaml:"remote_write"`
+        // Push sends metrics to a Prometheus Pushgateway on Interval
+        Push struct {
+                GatewayURL string            `yaml:"gateway_url"`
+                Job        string            `yaml:"job"`
+                Interval   time.Duration     `yaml:"interval"`
+                Timeout    time.Duration     `yaml:"timeout"`
+                Grouping   map[string]string `yaml:"grouping"`
+        } `yaml:"push"`
+        // DisableHTTP skips the HTTP server for push-only deployments
+        DisableHTTP bool `yaml:"disable_http"`
+        // DebugClassify serves the /debug/classify dry run, which lists
+        // every process's (redacted) command line
+        DebugClassify bool `yaml:"debug_classify"`
+        // EnableReloadEndpoint serves POST /-/reload; SIGHUP works either way
+        EnableReloadEndpoint bool `yaml:"enable_reload_endpoint"`
+        Experimental         struct {
+                // SuppressUnchanged leaves gauge series out of /metrics when
+                // their value equals the previous scrape's; breaks staleness
+                SuppressUnchanged bool `yaml:"suppress_unchanged"`
+        } `yaml:"experimental"`
+
+        excludeNames []*regexp.Regexp
+        redactArgs   []*regexp.Regexp
+        // EnvLabels keys, sorted, so label order is stable
+        envLabelNames []string
+}
+
+// TypeRule assigns Type to processes whose name, or full command line when
+// Cmdline is set, matches Pattern.
+type TypeRule struct {
+        Pattern string `yaml:"pattern"`
+        Type    string `yaml:"type"`
+        Cmdline bool   `yaml:"cmdline"`
+
+        re *regexp.Regexp
+}
+
+// NameRule names processes of Type (any type when empty) after the first
+// capture group of Match applied to the space-joined command line.
+type NameRule struct {
+        Match string `yaml:"match"`
+        Type  string `yaml:"type"`
+
+        re *regexp.Regexp
 }
 
 var config Config
 
+// registry holds the metrics written by collections, and liveRegistry the
+// ones that can be read at any time: the exporter's own process and Go
+// runtime, collection_in_progress_seconds and the debounced scrapes.
+// initMetrics replaces both on each config load.
+var (
+        registry     *prometheus.Registry
+        liveRegistry *prometheus.Registry
+)
+
+// exposition is what /metrics serves and push and remote write send: the
+// families gathered from registry at the end of the latest collection,
+// merged with a fresh gather of liveRegistry.
+type exposition struct {
+        gatherer prometheus.Gatherer
+        // handler serves gatherer, leaving out unchanged gauges with
+        // experimental.suppress_unchanged
+        handler http.Handler
+}
+
+// exposed is the current exposition. It is read without collectMu, so a
+// scrape never waits for a running collection.
+var exposed atomic.Pointer[exposition]
+
+// gathered is registry as gathered by publishCollected.
+type gathered struct {
+        mfs []*dto.MetricFamily
+        err error
+}
+
+var lastGathered atomic.Pointer[gathered]
+
+// collectMu serialises collection and config reloads, which both read and
+// replace the metric vectors.
+var collectMu sync.Mutex
+
 var (
-        memoryGauge *prometheus.GaugeVec
-        cpuGauge    *prometheus.GaugeVec
+        memoryGauge         *prometheus.GaugeVec
+        cpuGauge            *prometheus.GaugeVec
+        sharedMemoryGauge   *prometheus.GaugeVec
+        mappedFilesGauge    *prometheus.GaugeVec
+        realtimeGauge       *prometheus.GaugeVec
+        memoryLimitGauge    *prometheus.GaugeVec
+        exeDeletedGauge     *prometheus.GaugeVec
+        openFDsGauge        *prometheus.GaugeVec
+        fdLimitGauge        *prometheus.GaugeVec
+        numThreadsGauge     *prometheus.GaugeVec
+        voluntaryCtxGauge   *prometheus.GaugeVec
+        involuntaryCtxGauge *prometheus.GaugeVec
+        startTimeGauge      *prometheus.GaugeVec
+        lastSeenGauge       *prometheus.GaugeVec
+        jvmMaxHeapGauge     *prometheus.GaugeVec
+        jvmMinHeapGauge     *prometheus.GaugeVec
+        minorFaultsCounter  *prometheus.CounterVec
+        majorFaultsCounter  *prometheus.CounterVec
+        rssGauge            *prometheus.GaugeVec
+        vmsGauge            *prometheus.GaugeVec
+        swapGauge           *prometheus.GaugeVec
+        leakGauge           *prometheus.GaugeVec
+        processUpGauge      *prometheus.GaugeVec
+        threadCPUGauge      *prometheus.GaugeVec
+        runnableGauge       *prometheus.GaugeVec
+        numaMemoryGauge     *prometheus.GaugeVec
+        argCountGauge       *prometheus.GaugeVec
+        includeTypesGauge   *prometheus.GaugeVec
+        excludeTypesGauge   *prometheus.GaugeVec
+
+        // one per cpu_smoothing_windows entry, in the same order
+        smoothedCPUGauges []*prometheus.GaugeVec
+        // one per connectionStates entry, in the same order
+        connectionsGauges []*prometheus.GaugeVec
+
+        serverNearFDLimit prometheus.Gauge
+        serverProcessAge  *snapshotHistogram
+
+        memoryDistribution *snapshotHistogramVec
+
+        serverCPUCorePercent *prometheus.GaugeVec
+        serverDiskReadBytes  *prometheus.CounterVec
+        serverDiskWriteBytes *prometheus.CounterVec
 
         serverTotalMemoryMB = prometheus.NewGauge(
                 prometheus.GaugeOpts{
@@ -48,6 +363,20 @@ var (
                 },
         )
 
+        serverTotalMemoryBytes = prometheus.NewGauge(
+                prometheus.GaugeOpts{
+                        Name: "server_total_memory_bytes",
+                        Help: "Total server memory in bytes",
+                },
+        )
+
+        serverAvailableMemoryBytes = prometheus.NewGauge(
+                prometheus.GaugeOpts{
+                        Name: "server_available_memory_bytes",
+                        Help: "Available (free + cached) memory in bytes",
+                },
+        )
+
         serverTotalCPUCores = prometheus.NewGauge(
                 prometheus.GaugeOpts{
                         Name: "server_total_cpu_cores",
@@ -61,41 +390,481 @@ var (
                         Help: "Estimated number of free CPU cores (based on idle %)",
                 },
         )
+
+        serverCPUStealPercent = prometheus.NewGauge(
+                prometheus.GaugeOpts{
+                        Name: "server_cpu_steal_percent",
+                        Help: "Percent of CPU time stolen by the hypervisor since the previous scrape",
+                },
+        )
+
+        serverLoad1 = prometheus.NewGauge(
+                prometheus.GaugeOpts{
+                        Name: "server_load1",
+                        Help: "1-minute load average",
+                },
+        )
+
+        serverLoad5 = prometheus.NewGauge(
+                prometheus.GaugeOpts{
+                        Name: "server_load5",
+                        Help: "5-minute load average",
+                },
+        )
+
+        serverLoad15 = prometheus.NewGauge(
+                prometheus.GaugeOpts{
+                        Name: "server_load15",
+                        Help: "15-minute load average",
+                },
+        )
+
+        processCountByType = prometheus.NewGaugeVec(
+                prometheus.GaugeOpts{
+                        Name: "process_count_by_type",
+                        Help: "Matched processes per type in the most recent collection",
+                },
+                []string{"type"},
+        )
+
+        processMemoryByType = prometheus.NewGaugeVec(
+                prometheus.GaugeOpts{
+                        Name: "process_memory_total_mb_by_type",
+                        Help: "Total RSS in MB of the matched processes per type",
+                },
+                []string{"type"},
+        )
+
+        filteredTotal = prometheus.NewCounterVec(
+                prometheus.CounterOpts{
+                        Name: "process_scout_filtered_total",
+                        Help: "Processes dropped by each filter",
+                },
+                []string{"filter"},
+        )
+
+        collectionInProgress = prometheus.NewGaugeFunc(
+                prometheus.GaugeOpts{
+                        Name: "process_scout_collection_in_progress_seconds",
+                        Help: "Elapsed time of the collection currently running, 0 when idle",
+                },
+                func() float64 {
+                        start := collectionStart.Load()
+                        if start == 0 {
+                                return 0
+                        }
+                        return time.Since(time.Unix(0, start)).Seconds()
+                },
+        )
+
+        collectionPanics = prometheus.NewCounter(
+                prometheus.CounterOpts{
+                        Name: "process_scout_collection_panics_total",
+                        Help: "Panics recovered while collecting a single process",
+                },
+        )
+
+        collectionErrors = prometheus.NewCounterVec(
+                prometheus.CounterOpts{
+                        Name: "processscout_collection_errors_total",
+                        Help: "Failed reads during collection, by operation",
+                },
+                []string{"operation"},
+        )
+
+        scrapeDuration = prometheus.NewGauge(
+                prometheus.GaugeOpts{
+                        Name: "processscout_scrape_duration_seconds",
+                        Help: "Duration of the most recent collection",
+                },
+        )
+
+        processesScanned = prometheus.NewCounter(
+                prometheus.CounterOpts{
+                        Name: "processscout_processes_scanned_total",
+                        Help: "Processes examined across all collections",
+                },
+        )
+
+        processesMatched = prometheus.NewGauge(
+                prometheus.GaugeOpts{
+                        Name: "processscout_processes_matched",
+                        Help: "Processes that passed all filters in the most recent collection",
+                },
+        )
+
+        scrapeErrors = prometheus.NewCounter(
+                prometheus.CounterOpts{
+                        Name: "processscout_scrape_errors_total",
+                        Help: "Collections that hit at least one host-level read error",
+                },
+        )
+
+        scrapesDebounced = prometheus.NewCounter(
+                prometheus.CounterOpts{
+                        Name: "process_scout_debounced_scrapes_total",
+                        Help: "collect_on_scrape requests served the previous results because of min_scrape_interval",
+                },
+        )
 )
 
-func loadConfig(path string) {
-        data, err := os.ReadFile(path)
+// collectionFailed is set by collectionError during a collection so it is
+// counted once in scrapeErrors.
+var collectionFailed bool
+
+// collectionError counts a failed host-level read and logs it. Per-process
+// failures are only counted, since exiting processes cause them routinely.
+func collectionError(operation string, err error) {
+        collectionErrors.WithLabelValues(operation).Inc()
+        collectionFailed = true
+        slog.Error("collection failed", "operation", operation, "err", err)
+}
+
+// envConfigVar holds the whole YAML config when it isn't read from a file.
+const envConfigVar = "PROCESSSCOUT_CONFIG"
+
+// envConfigPath is the config path standing for the envConfigVar contents.
+const envConfigPath = "$" + envConfigVar
+
+// loadConfig reads the YAML config from path, from stdin when path is "-"
+// or from $PROCESSSCOUT_CONFIG when path is envConfigPath.
+// It doesn't touch the running config, so a bad file on reload leaves the
+// exporter as it was.
+func loadConfig(path string) (Config, error) {
+        var data []byte
+        var err error
+        switch path {
+        case "-":
+                data, err = io.ReadAll(os.Stdin)
+                path = "<stdin>"
+        case envConfigPath:
+                data = []byte(os.Getenv(envConfigVar))
+        default:
+                data, err = os.ReadFile(path)
+        }
         if err != nil {
-                log.Fatalf("failed to read config file: %v", err)
+                return Config{}, fmt.Errorf("failed to read config file: %w", err)
+        }
+        var c Config
+        // defaults that YAML may override with false / 0
+        c.ExcludeSelf = true
+        c.MinScrapeInterval = 5 * time.Second
+        // unknown keys are errors so typos don't silently fall back to defaults
+        dec := yaml.NewDecoder(bytes.NewReader(data))
+        dec.KnownFields(true)
+        if err := dec.Decode(&c); err != nil && !errors.Is(err, io.EOF) {
+                return Config{}, fmt.Errorf("failed to parse config: %s", configError(path, err))
+        }
+
+        if c.ListenAddress == "" {
+                c.ListenAddress = ":9001"
+        }
+        if err := checkListenAddress(c.ListenAddress); err != nil {
+                return Config{}, fmt.Errorf("%s: invalid listen_address %q: %v", path, c.ListenAddress, err)
+        }
+        if c.ProcPath == "" {
+                c.ProcPath = os.Getenv("HOST_PROC")
+        }
+        if c.ProcPath == "" {
+                c.ProcPath = "/proc"
+        }
+        if c.MetricsPath == "" {
+                c.MetricsPath = "/metrics"
+        }
+        if !strings.HasPrefix(c.MetricsPath, "/") {
+                return Config{}, fmt.Errorf("%s: invalid metrics_path %q: must start with /", path, c.MetricsPath)
+        }
+        switch c.MetricsPath {
+        case "/snapshot", "/healthz", "/debug/classify", "/-/reload":
+                return Config{}, fmt.Errorf("%s: invalid metrics_path %q: already used by another endpoint", path, c.MetricsPath)
+        }
+        switch c.LogLevel {
+        case "":
+                c.LogLevel = "info"
+        case "debug", "info", "warn", "error":
+        default:
+                return Config{}, fmt.Errorf("%s: invalid log_level %q: must be debug, info, warn or error", path, c.LogLevel)
+        }
+        switch c.LogFormat {
+        case "":
+                c.LogFormat = "text"
+        case "text", "json":
+        default:
+                return Config{}, fmt.Errorf("%s: invalid log_format %q: must be text or json", path, c.LogFormat)
+        }
+        if len(c.IncludeTypes) == 0 {
+                c.IncludeTypes = []string{"java", "python"}
+        }
+        for _, pattern := range c.ExcludeNames {
+                re, err := regexp.Compile(pattern)
+                if err != nil {
+                        return Config{}, fmt.Errorf("%s: exclude_names: invalid pattern %q: %v", path, pattern, err)
+                }
+                c.excludeNames = append(c.excludeNames, re)
+        }
+        if c.CmdlineMaxLength < 0 {
+                return Config{}, fmt.Errorf("%s: cmdline_max_length must not be negative", path)
+        }
+        if c.CmdlineMaxLength == 0 {
+                c.CmdlineMaxLength = 256
+        }
+        for _, pattern := range c.RedactArgs {
+                re, err := regexp.Compile(pattern)
+                if err != nil {
+                        return Config{}, fmt.Errorf("%s: redact_args: invalid pattern %q: %v", path, pattern, err)
+                }
+                c.redactArgs = append(c.redactArgs, re)
+        }
+        switch c.UnknownUsers {
+        case "":
+                c.UnknownUsers = "include"
+        case "include", "exclude":
+        default:
+                return Config{}, fmt.Errorf("%s: invalid unknown_users %q: must be include or exclude", path, c.UnknownUsers)
+        }
+        if c.LabelSeparator == "" {
+                c.LabelSeparator = "/"
+        }
+        for i := range c.TypeRules {
+                rule := &c.TypeRules[i]
+                if rule.Type == "" {
+                        return Config{}, fmt.Errorf("%s: type_rules[%d] has no type", path, i)
+                }
+                rule.re, err = regexp.Compile(rule.Pattern)
+                if err != nil {
+                        return Config{}, fmt.Errorf("%s: type_rules[%d]: invalid pattern %q: %v", path, i, rule.Pattern, err)
+                }
+        }
+        for name := range c.EnvLabels {
+                if !labelNameRe.MatchString(name) {
+                        return Config{}, fmt.Errorf("%s: env_labels: invalid label name %q", path, name)
+                }
+                if contains(builtinLabelNames, name) {
+                        return Config{}, fmt.Errorf("%s: env_labels: label %q is already used by ProcessScout", path, name)
+                }
+                c.envLabelNames = append(c.envLabelNames, name)
+        }
+        sort.Strings(c.envLabelNames)
+        for i := range c.NameRules {
+                rule := &c.NameRules[i]
+                rule.re, err = regexp.Compile(rule.Match)
+                if err != nil {
+                        return Config{}, fmt.Errorf("%s: name_rules[%d]: invalid match %q: %v", path, i, rule.Match, err)
+                }
+                if rule.re.NumSubexp() == 0 {
+                        return Config{}, fmt.Errorf("%s: name_rules[%d]: match %q has no capture group", path, i, rule.Match)
+                }
+        }
+        for _, w := range c.CPUSmoothingWindows {
+                if w < time.Second {
+                        return Config{}, fmt.Errorf("%s: cpu_smoothing_windows entries must be at least 1s, got %s", path, w)
+                }
+        }
+        switch c.TopBy {
+        case "":
+                c.TopBy = "memory"
+        case "memory", "cpu":
+        default:
+                return Config{}, fmt.Errorf("%s: invalid top_by %q: must be memory or cpu", path, c.TopBy)
+        }
+        if c.LeakDetection.Samples == 1 || c.LeakDetection.Samples < 0 {
+                return Config{}, fmt.Errorf("%s: leak_detection.samples must be 0 (off) or at least 2", path)
+        }
+        if c.KeepMissingFor < 0 {
+                return Config{}, fmt.Errorf("%s: keep_missing_for must not be negative", path)
+        }
+        if c.CgroupSubtree != "" {
+                if !hasCgroups {
+                        return Config{}, fmt.Errorf("%s: cgroup_subtree is not supported on %s", path, runtime.GOOS)
+                }
+                if !strings.HasPrefix(c.CgroupSubtree, "/") {
+                        return Config{}, fmt.Errorf("%s: cgroup_subtree must be an absolute cgroup path", path)
+                }
+                c.CgroupSubtree = strings.TrimSuffix(c.CgroupSubtree, "/")
+        }
+        if len(c.ProcessAgeBuckets) == 0 {
+                // 1m, 5m, 15m, 1h, 6h, 1d, 1w
+                c.ProcessAgeBuckets = []float64{60, 300, 900, 3600, 21600, 86400, 604800}
+        }
+        if !sort.Float64sAreSorted(c.ProcessAgeBuckets) {
+                return Config{}, fmt.Errorf("%s: process_age_buckets must be in increasing order", path)
+        }
+        mh := &c.MemoryHistogramBuckets
+        if mh.Start == 0 && mh.Factor == 0 && mh.Count == 0 {
+                // 16MB .. 8GB
+                mh.Start, mh.Factor, mh.Count = 16, 2, 10
+        }
+        if mh.Start <= 0 || mh.Factor <= 1 || mh.Count < 1 {
+                return Config{}, fmt.Errorf("%s: memory_histogram_buckets needs start > 0, factor > 1 and count >= 1", path)
+        }
+        if c.FDLimitRatio == 0 {
+                c.FDLimitRatio = 0.8
+        }
+        if c.FDLimitRatio < 0 || c.FDLimitRatio > 1 {
+                return Config{}, fmt.Errorf("%s: fd_limit_ratio must be between 0 and 1", path)
+        }
+        if c.MaxSeries < 0 {
+                return Config{}, fmt.Errorf("%s: max_series must not be negative", path)
+        }
+        if c.CollectionWorkers < 0 {
+                return Config{}, fmt.Errorf("%s: collection_workers must not be negative", path)
+        }
+        if c.CollectionWorkers == 0 {
+                c.CollectionWorkers = runtime.NumCPU()
+        }
+        if c.MinMemoryMB < 0 || c.MinCPUPercent < 0 {
+                return Config{}, fmt.Errorf("%s: min_memory_mb and min_cpu_percent must not be negative", path)
+        }
+        if c.NameFromArgs == nil {
+                c.NameFromArgs = []string{"-D.system.id="}
+        }
+        if c.NameMaxArgs < 0 {
+                return Config{}, fmt.Errorf("%s: name_max_args must not be negative", path)
+        }
+        c.MetricPrefix = strings.TrimSuffix(c.MetricPrefix, "_")
+        if c.MetricPrefix != "" && !metricNameRe.MatchString(c.MetricPrefix) {
+                return Config{}, fmt.Errorf("%s: invalid metric_prefix %q: must match %s", path, c.MetricPrefix, metricNameRe)
+        }
+        if c.HostLabel == "auto" {
+                host, err := os.Hostname()
+                if err != nil {
+                        return Config{}, fmt.Errorf("%s: host_label is auto but the hostname is unavailable: %v", path, err)
+                }
+                c.HostLabel = host
+        }
+        if c.MinScrapeInterval < 0 {
+                return Config{}, fmt.Errorf("%s: min_scrape_interval must not be negative", path)
+        }
+        if c.ScrapeInterval <= 0 {
+                c.ScrapeInterval = 15 * time.Second
+        }
+        if c.HostCPUSampleInterval <= 0 {
+                c.HostCPUSampleInterval = 5 * time.Second
+        }
+        if c.Classifier.Timeout <= 0 {
+                c.Classifier.Timeout = 2 * time.Second
+        }
+        if (c.BasicAuth.Username == "") != (c.BasicAuth.PasswordHash == "") {
+                return Config{}, fmt.Errorf("%s: basic_auth needs both username and password_hash", path)
+        }
+        if c.BasicAuth.PasswordHash != "" {
+                if _, err := bcrypt.Cost([]byte(c.BasicAuth.PasswordHash)); err != nil {
+                        return Config{}, fmt.Errorf("%s: basic_auth.password_hash is not a bcrypt hash: %v", path, err)
+                }
+        }
+        if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+                return Config{}, fmt.Errorf("%s: tls needs both cert_file and key_file", path)
+        }
+        if c.RemoteWrite.Interval <= 0 {
+                c.RemoteWrite.Interval = 15 * time.Second
+        }
+        if c.RemoteWrite.Timeout <= 0 {
+                c.RemoteWrite.Timeout = 10 * time.Second
+        }
+        if c.Push.Job == "" {
+                c.Push.Job = "process_scout"
+        }
+        if c.Push.Interval <= 0 {
+                c.Push.Interval = 15 * time.Second
+        }
+        if c.Push.Timeout <= 0 {
+                c.Push.Timeout = 10 * time.Second
+        }
+        if c.DisableHTTP && c.Push.GatewayURL == "" && c.RemoteWrite.URL == "" {
+                return Config{}, fmt.Errorf("%s: disable_http needs push.gateway_url or remote_write.url, or nothing would export metrics", path)
         }
-        if err := yaml.Unmarshal(data, &config); err != nil {
-                log.Fatalf("failed to parse config: %v", err)
+        if c.SampleTimestamps && c.Push.GatewayURL != "" {
+                return Config{}, fmt.Errorf("%s: sample_timestamps can't be used with push.gateway_url, the Pushgateway rejects samples with timestamps", path)
         }
+        return c, nil
+}
+
+// labelNameRe is Prometheus's label name syntax.
+var labelNameRe = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// builtinLabelNames are the labels ProcessScout itself may attach.
+var builtinLabelNames = []string{"cwd", "process_name", "type", "user", "container_runtime", "wchan", "tty", "python_details", "parent_name", "cmdline", "process", "host"}
+
+// metricNameRe is Prometheus's metric name syntax.
+var metricNameRe = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
 
-        if config.ListenAddress == "" {
-                config.ListenAddress = ":9001"
+var yamlLineRe = regexp.MustCompile(`^(?:yaml: )?line (\d+): (.*)$`)
+
+// configError formats a YAML error as "path:line: message" so operators can
+// jump straight to the offending line. yaml.v3 reports several type errors
+// at once; each gets its own line.
+func configError(path string, err error) string {
+        var typeErr *yaml.TypeError
+        if errors.As(err, &typeErr) {
+                msgs := make([]string, 0, len(typeErr.Errors))
+                for _, e := range typeErr.Errors {
+                        msgs = append(msgs, configErrorLine(path, e))
+                }
+                return strings.Join(msgs, "\n")
         }
-        if len(config.IncludeTypes) == 0 {
-                config.IncludeTypes = []string{"java", "python"}
+        return configErrorLine(path, err.Error())
+}
+
+func configErrorLine(path, msg string) string {
+        if m := yamlLineRe.FindStringSubmatch(msg); m != nil {
+                return fmt.Sprintf("%s:%s: %s", path, m[1], m[2])
         }
+        return fmt.Sprintf("%s: %s", path, strings.TrimPrefix(msg, "yaml: "))
 }
 
+// initMetrics builds a fresh registry for the current config and points
+// /metrics and remote write at it. Callers other than main must hold
+// collectMu.
 func initMetrics() {
-        // dynamic labels
-        labels := []string{}
-        if config.Labels.Cwd {
-                labels = append(labels, "cwd")
-        }
-        if config.Labels.ProcessName {
-                labels = append(labels, "process_name")
+        // drop optional metrics left over from a previous config
+        for _, g := range []**prometheus.GaugeVec{
+                &sharedMemoryGauge, &mappedFilesGauge, &realtimeGauge, &memoryLimitGauge,
+                &exeDeletedGauge, &openFDsGauge, &fdLimitGauge, &leakGauge,
+                &numThreadsGauge, &voluntaryCtxGauge, &involuntaryCtxGauge, &startTimeGauge, &lastSeenGauge,
+                &jvmMaxHeapGauge, &jvmMinHeapGauge,
+                &rssGauge, &vmsGauge, &swapGauge,
+                &processUpGauge, &threadCPUGauge, &runnableGauge, &numaMemoryGauge, &argCountGauge,
+        } {
+                *g = nil
         }
-        if config.Labels.Type {
-                labels = append(labels, "type")
+        smoothedCPUGauges = nil
+        connectionsGauges = nil
+        serverNearFDLimit = nil
+        serverProcessAge = nil
+        memoryDistribution = nil
+        serverCPUCorePercent = nil
+        serverDiskReadBytes, serverDiskWriteBytes = nil, nil
+        minorFaultsCounter, majorFaultsCounter = nil, nil
+
+        registry = prometheus.NewRegistry()
+        liveRegistry = prometheus.NewRegistry()
+        // the exporter's own process metrics are namespaced so they don't
+        // clash with per-process metrics like process_open_fds
+        liveRegistry.MustRegister(
+                collectors.NewGoCollector(),
+                collectors.NewProcessCollector(collectors.ProcessCollectorOpts{Namespace: "process_scout"}),
+        )
+
+        // every exporter metric carries the host label when configured
+        wrap := func(reg prometheus.Registerer) prometheus.Registerer {
+                if config.HostLabel != "" {
+                        reg = prometheus.WrapRegistererWith(prometheus.Labels{"host": config.HostLabel}, reg)
+                }
+                if config.MetricPrefix != "" {
+                        reg = prometheus.WrapRegistererWithPrefix(config.MetricPrefix+"_", reg)
+                }
+                return reg
         }
-        if config.Labels.User {
-                labels = append(labels, "user")
+        reg := wrap(registry)
+        wrap(liveRegistry).MustRegister(collectionInProgress, scrapesDebounced)
+        // per-process metrics optionally carry the collection timestamp
+        procReg := reg
+        if config.SampleTimestamps {
+                procReg = timestampRegisterer{reg}
         }
 
+        labels := labelNames()
+
         memoryGauge = prometheus.NewGaugeVec(
                 prometheus.GaugeOpts{
                         Name: "process_memory_mb",
@@ -112,137 +881,2625 @@ func initMetrics() {
                 labels,
         )
 
-        prometheus.MustRegister(memoryGauge, cpuGauge,
+        for _, w := range config.CPUSmoothingWindows {
+                g := prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_cpu_percent_" + windowSuffix(w),
+                                Help: fmt.Sprintf("CPU usage percent, exponentially weighted over %s", w),
+                        },
+                        labels,
+                )
+                smoothedCPUGauges = append(smoothedCPUGauges, g)
+                procReg.MustRegister(g)
+        }
+
+        procReg.MustRegister(memoryGauge, cpuGauge)
+        reg.MustRegister(
                 serverTotalMemoryMB, serverAvailableMemoryMB,
+                serverTotalMemoryBytes, serverAvailableMemoryBytes,
                 serverTotalCPUCores, serverAvailableCPUCores,
+                serverCPUStealPercent,
+                serverLoad1, serverLoad5, serverLoad15,
+                processCountByType, processMemoryByType,
+                filteredTotal, collectionPanics, collectionErrors,
+                scrapeDuration, processesScanned, processesMatched, scrapeErrors,
         )
-}
+        for _, op := range []string{"virtual_memory", "cpu_counts", "process_list", "memory_info", "cpu_times", "connections"} {
+                collectionErrors.WithLabelValues(op)
+        }
+        for _, filter := range []string{"exclude_self", "kernel_threads", "include_types", "exclude_types", "exclude_names", "users", "cgroup_subtree", "parent_name", "thresholds"} {
+                filteredTotal.WithLabelValues(filter)
+        }
 
-func getProcessType(p *process.Process) string {
-        name, _ := p.Name()
-        name = strings.ToLower(name)
+        // loaded filter config, for auditing hosts via PromQL
+        includeTypesGauge = prometheus.NewGaugeVec(
+                prometheus.GaugeOpts{
+                        Name: "process_scout_include_types",
+                        Help: "Number of configured include_types; the types label lists them",
+                },
+                []string{"types"},
+        )
+        reg.MustRegister(includeTypesGauge)
+        includeTypesGauge.WithLabelValues(sortedJoin(config.IncludeTypes)).Set(float64(len(config.IncludeTypes)))
+        excludeTypesGauge = prometheus.NewGaugeVec(
+                prometheus.GaugeOpts{
+                        Name: "process_scout_exclude_types",
+                        Help: "Number of configured exclude_types; the types label lists them",
+                },
+                []string{"types"},
+        )
+        reg.MustRegister(excludeTypesGauge)
+        excludeTypesGauge.WithLabelValues(sortedJoin(config.ExcludeTypes)).Set(float64(len(config.ExcludeTypes)))
 
-        switch {
-        case strings.Contains(name, "java"):
-                return "java"
-        case strings.Contains(name, "python"):
-                return "python"
-        case strings.Contains(name, "node"):
-                return "node"
-        case strings.Contains(name, "docker"), strings.Contains(name, "containerd"):
-                return "docker"
-        default:
-                // detect docker cgroup
-                cgroupPath := fmt.Sprintf("/proc/%d/cgroup", p.Pid)
-                data, err := os.ReadFile(cgroupPath)
-                if err == nil && strings.Contains(string(data), "docker") {
-                        return "docker_app"
-                }
-                // mark everything else as system
-                return "system"
+        // optional metrics
+        if config.Memory.RSS {
+                rssGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_memory_rss_mb",
+                                Help: "Resident set size in MB",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(rssGauge)
         }
-}
 
-func getProcessName(p *process.Process, ptype string) string {
-        if ptype == "java" || ptype == "python" {
-                cmdline, _ := p.CmdlineSlice()
-                for _, arg := range cmdline {
-                        if strings.HasPrefix(arg, "-D.system.id=") {
-                                return strings.SplitN(arg, "=", 2)[1]
-                        }
-                }
+        if config.Memory.VMS {
+                vmsGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_memory_vms_mb",
+                                Help: "Virtual memory size in MB",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(vmsGauge)
         }
-        name, _ := p.Name()
-        return name
-}
 
-func getWorkingDirectory(p *process.Process) string {
-        cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", p.Pid))
-        if err != nil {
-                return "(unknown)"
+        if config.Memory.Swap {
+                swapGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_memory_swap_mb",
+                                Help: "Swapped-out memory in MB",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(swapGauge)
         }
-        abs, err := filepath.Abs(cwd)
-        if err != nil {
-                return cwd
+
+        if config.Metrics.SharedMemory {
+                sharedMemoryGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_shared_memory_mb",
+                                Help: "Shared memory (file-backed and shm pages counted in RSS) in MB",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(sharedMemoryGauge)
         }
-        return abs
-}
 
-func collectMetrics() {
-        memoryGauge.Reset()
-        cpuGauge.Reset()
+        if config.Metrics.MappedFiles {
+                mappedFilesGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_mapped_files",
+                                Help: "Number of distinct files memory-mapped by the process",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(mappedFilesGauge)
+        }
 
-        vm, _ := mem.VirtualMemory()
-        serverTotalMemoryMB.Set(float64(vm.Total) / (1024 * 1024))
-        serverAvailableMemoryMB.Set(float64(vm.Available) / (1024 * 1024))
+        if config.Metrics.SchedPolicy {
+                realtimeGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_realtime",
+                                Help: "1 if the process runs under a real-time scheduling policy (SCHED_FIFO/SCHED_RR)",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(realtimeGauge)
+        }
 
-        cores, _ := cpu.Counts(true)
-        serverTotalCPUCores.Set(float64(cores))
+        if config.Metrics.MemoryLimit {
+                memoryLimitGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_memory_limit_mb",
+                                Help: "Soft address-space limit (RLIMIT_AS) in MB; absent when unlimited",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(memoryLimitGauge)
+        }
 
-        // idle % -> available cores
-        cpuPercents, err := cpu.Percent(0, false)
-        if err == nil && len(cpuPercents) > 0 {
-                idlePercent := 100.0 - cpuPercents[0]
-                freeCores := (idlePercent / 100.0) * float64(cores)
-                serverAvailableCPUCores.Set(freeCores)
+        if config.Metrics.JVM {
+                jvmMaxHeapGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_jvm_max_heap_mb",
+                                Help: "Maximum heap size in MB from -Xmx on the command line (java processes only)",
+                        },
+                        labels,
+                )
+                jvmMinHeapGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_jvm_min_heap_mb",
+                                Help: "Initial heap size in MB from -Xms on the command line (java processes only)",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(jvmMaxHeapGauge, jvmMinHeapGauge)
         }
 
-        procs, _ := process.Processes()
-        for _, p := range procs {
-                ptype := getProcessType(p)
-                if !contains(config.IncludeTypes, ptype) {
-                        continue
-                }
+        if config.LeakDetection.Samples > 0 {
+                leakGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_memory_leak_suspected",
+                                Help: "1 if RSS grew on every one of the last leak_detection.samples scrapes faster than min_growth_mb_per_hour",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(leakGauge)
+        }
 
-                labels := []string{}
-                if config.Labels.Cwd {
-                        labels = append(labels, getWorkingDirectory(p))
-                }
-                if config.Labels.ProcessName {
-                        labels = append(labels, getProcessName(p, ptype))
-                }
-                if config.Labels.Type {
-                        labels = append(labels, ptype)
-                }
-                if config.Labels.User {
-                        username, _ := p.Username()
-                        labels = append(labels, username)
-                }
+        if config.Metrics.ExeDeleted {
+                exeDeletedGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_exe_deleted",
+                                Help: "1 if the process's executable has been deleted or replaced on disk",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(exeDeletedGauge)
+        }
 
-                memInfo, err := p.MemoryInfo()
-                if err != nil {
-                        continue
-                }
-                memMB := float64(memInfo.RSS) / (1024 * 1024)
-                cpuPercent, _ := p.CPUPercent()
+        if config.Metrics.OpenFDs {
+                openFDsGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_open_fds",
+                                Help: "Number of open file descriptors",
+                        },
+                        labels,
+                )
+                fdLimitGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_open_fds_limit",
+                                Help: "Soft open-files limit (RLIMIT_NOFILE); absent when unlimited",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(openFDsGauge, fdLimitGauge)
+        }
 
-                memoryGauge.WithLabelValues(labels...).Set(memMB)
-                cpuGauge.WithLabelValues(labels...).Set(cpuPercent)
+        if config.Metrics.Threads {
+                numThreadsGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_num_threads",
+                                Help: "Number of threads in the process",
+                        },
+                        labels,
+                )
+                voluntaryCtxGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_ctx_switches_voluntary",
+                                Help: "Voluntary context switches since the process started",
+                        },
+                        labels,
+                )
+                involuntaryCtxGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_ctx_switches_involuntary",
+                                Help: "Involuntary context switches since the process started",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(numThreadsGauge, voluntaryCtxGauge, involuntaryCtxGauge)
         }
-}
 
-func metricsHandler(w http.ResponseWriter, r *http.Request) {
-        collectMetrics()
-        promhttp.Handler().ServeHTTP(w, r)
-}
+        if config.Metrics.StartTime {
+                startTimeGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_start_time_seconds",
+                                Help: "Start time of the process since unix epoch in seconds",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(startTimeGauge)
+        }
 
-func contains(slice []string, val string) bool {
-        for _, v := range slice {
-                if v == val {
+        if config.Metrics.PageFaults {
+                minorFaultsCounter = prometheus.NewCounterVec(
+                        prometheus.CounterOpts{
+                                Name: "process_minor_faults_total",
+                                Help: "Page faults served without disk I/O since process start",
+                        },
+                        labels,
+                )
+                majorFaultsCounter = prometheus.NewCounterVec(
+                        prometheus.CounterOpts{
+                                Name: "process_major_faults_total",
+                                Help: "Page faults that needed disk I/O since process start",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(minorFaultsCounter, majorFaultsCounter)
+        }
+
+        if config.Metrics.LastSeen {
+                lastSeenGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_last_seen_timestamp_seconds",
+                                Help: "Unix time of the last collection that saw the process",
+                        },
+                        labels,
+                )
+                procReg.MustRegister(lastSeenGauge)
+        }
+
+        // one vector per state, told apart by a constant state label, so
+        // they fit the per-process sample and expiry handling
+        if config.Metrics.Connections {
+                for _, state := range connectionStates {
+                        g := prometheus.NewGaugeVec(
+                                prometheus.GaugeOpts{
+                                        Name:        "process_connections",
+                                        Help:        "TCP and UDP sockets held by the process, by state",
+                                        ConstLabels: prometheus.Labels{"state": state},
+                                },
+                                labels,
+                        )
+                        connectionsGauges = append(connectionsGauges, g)
+                        procReg.MustRegister(g)
+                }
+        }
+
+        if len(config.WatchNames) > 0 {
+                processUpGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_up",
+                                Help: "1 if at least one process with the watched name is running, 0 otherwise",
+                        },
+                        []string{"name"},
+                )
+                reg.MustRegister(processUpGauge)
+        }
+
+        // deep per-thread metrics, only for watched processes
+        if config.Metrics.ThreadCPU && len(config.WatchNames) > 0 {
+                threadCPUGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_thread_cpu_percent",
+                                Help: "CPU usage percent per thread of watched processes",
+                        },
+                        []string{"name", "pid", "tid"},
+                )
+                reg.MustRegister(threadCPUGauge)
+        }
+        if config.Metrics.RunnableThreads && len(config.WatchNames) > 0 {
+                runnableGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_runnable_threads",
+                                Help: "Threads of watched processes currently in the runnable (R) state",
+                        },
+                        []string{"name", "pid"},
+                )
+                reg.MustRegister(runnableGauge)
+        }
+        if config.Metrics.NUMAMemory && len(config.WatchNames) > 0 {
+                numaMemoryGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_numa_memory_mb",
+                                Help: "Resident memory of watched processes per NUMA node in MB",
+                        },
+                        []string{"name", "pid", "node"},
+                )
+                reg.MustRegister(numaMemoryGauge)
+        }
+        if config.Metrics.CmdlineArgCount && len(config.WatchNames) > 0 {
+                argCountGauge = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "process_cmdline_arg_count",
+                                Help: "Number of command-line arguments of watched processes",
+                        },
+                        []string{"name", "pid"},
+                )
+                reg.MustRegister(argCountGauge)
+        }
+
+        if config.Metrics.NearFDLimit {
+                serverNearFDLimit = prometheus.NewGauge(
+                        prometheus.GaugeOpts{
+                                Name: "server_processes_near_fd_limit",
+                                Help: "Matched processes whose open FDs exceed fd_limit_ratio of their soft RLIMIT_NOFILE",
+                        },
+                )
+                reg.MustRegister(serverNearFDLimit)
+        }
+
+        if config.Metrics.ProcessAge {
+                serverProcessAge = newSnapshotHistogram(
+                        "server_process_age_seconds",
+                        "Distribution of the ages of all processes on the host",
+                        config.ProcessAgeBuckets,
+                )
+                reg.MustRegister(serverProcessAge)
+        }
+
+        if config.Metrics.MemoryHistogram {
+                mh := config.MemoryHistogramBuckets
+                memoryDistribution = newSnapshotHistogramVec(
+                        "process_memory_distribution_mb",
+                        "Distribution of the RSS in MB of matched processes, by type",
+                        "type",
+                        prometheus.ExponentialBuckets(mh.Start, mh.Factor, mh.Count),
+                )
+                reg.MustRegister(memoryDistribution)
+        }
+
+        if config.Metrics.PerCPU {
+                serverCPUCorePercent = prometheus.NewGaugeVec(
+                        prometheus.GaugeOpts{
+                                Name: "server_cpu_core_percent",
+                                Help: "Busy percent per logical CPU core since the previous scrape",
+                        },
+                        []string{"core"},
+                )
+                reg.MustRegister(serverCPUCorePercent)
+        }
+
+        if config.Metrics.DiskIO {
+                serverDiskReadBytes = prometheus.NewCounterVec(
+                        prometheus.CounterOpts{
+                                Name: "server_disk_read_bytes_total",
+                                Help: "Total bytes read from the block device",
+                        },
+                        []string{"device"},
+                )
+                serverDiskWriteBytes = prometheus.NewCounterVec(
+                        prometheus.CounterOpts{
+                                Name: "server_disk_write_bytes_total",
+                                Help: "Total bytes written to the block device",
+                        },
+                        []string{"device"},
+                )
+                reg.MustRegister(serverDiskReadBytes, serverDiskWriteBytes)
+        }
+
+        publishCollected()
+        exposed.Store(newExposition(liveRegistry))
+}
+
+// newExposition serves the last published collection together with live.
+func newExposition(live *prometheus.Registry) *exposition {
+        collected := prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+                g := lastGathered.Load()
+                if g == nil {
+                        return nil, nil
+                }
+                return g.mfs, g.err
+        })
+        // Gatherers merges into new families, so the published ones are
+        // never modified by the unchanged gatherer
+        e := &exposition{gatherer: prometheus.Gatherers{collected, live}}
+        served := e.gatherer
+        if config.Experimental.SuppressUnchanged {
+                slog.Warn("experimental.suppress_unchanged is on: unchanged gauges are left out of /metrics, which breaks Prometheus staleness handling")
+                served = newUnchangedGatherer(served)
+        }
+        // OpenMetrics is only served to scrapers that ask for it in Accept
+        e.handler = promhttp.InstrumentMetricHandler(live, promhttp.HandlerFor(served, promhttp.HandlerOpts{EnableOpenMetrics: true}))
+        return e
+}
+
+// publishCollected gathers registry for the exposition. It is called with
+// collectMu held once a collection has written every metric, so scrapes
+// never see a collection half done.
+func publishCollected() {
+        mfs, err := registry.Gather()
+        lastGathered.Store(&gathered{mfs: mfs, err: err})
+}
+
+// lastCollect is when the most recent collectMetrics run started.
+var lastCollect atomic.Value
+
+// lastCollectDone is when the most recent collectMetrics run finished.
+// Guarded by collectMu.
+var lastCollectDone time.Time
+
+// lastSamples are the processes matched by the most recent collection that
+// could list processes, served on /snapshot.
+var lastSamples atomic.Pointer[[]*ProcessSample]
+
+// scrapeSummary describes a completed collection for /healthz.
+type scrapeSummary struct {
+        at        time.Time
+        processes int
+}
+
+// lastScrape is the most recent collection that could list processes; nil
+// until one has completed.
+var lastScrape atomic.Pointer[scrapeSummary]
+
+// collectionStart is the UnixNano start of the running collection, 0 when
+// idle. A value that keeps growing points at a hung /proc read.
+var collectionStart atomic.Int64
+
+// timestampRegisterer registers collectors wrapped in timestampCollector.
+type timestampRegisterer struct {
+        prometheus.Registerer
+}
+
+func (r timestampRegisterer) Register(c prometheus.Collector) error {
+        return r.Registerer.Register(timestampCollector{c})
+}
+
+func (r timestampRegisterer) MustRegister(cs ...prometheus.Collector) {
+        for _, c := range cs {
+                if err := r.Register(c); err != nil {
+                        panic(err)
+                }
+        }
+}
+
+// timestampCollector attaches the last collection time to every metric of
+// the wrapped collector.
+type timestampCollector struct {
+        prometheus.Collector
+}
+
+func (c timestampCollector) Collect(ch chan<- prometheus.Metric) {
+        ts, ok := lastCollect.Load().(time.Time)
+        if !ok {
+                c.Collector.Collect(ch)
+                return
+        }
+        inner := make(chan prometheus.Metric)
+        go func() {
+                c.Collector.Collect(inner)
+                close(inner)
+        }()
+        for m := range inner {
+                ch <- prometheus.NewMetricWithTimestamp(ts, m)
+        }
+}
+
+// labelNames returns the dynamic per-process label names enabled in config,
+// or the single "process" label in flat mode.
+func labelNames() []string {
+        if config.FlatLabels {
+                return []string{"process"}
+        }
+        labels := []string{}
+        if config.Labels.Cwd {
+                labels = append(labels, "cwd")
+        }
+        if config.Labels.ProcessName {
+                labels = append(labels, "process_name")
+        }
+        if config.Labels.Type {
+                labels = append(labels, "type")
+        }
+        if config.Labels.User {
+                labels = append(labels, "user")
+        }
+        if config.Labels.ContainerRuntime {
+                labels = append(labels, "container_runtime")
+        }
+        if config.Labels.Wchan {
+                labels = append(labels, "wchan")
+        }
+        if config.Labels.TTY {
+                labels = append(labels, "tty")
+        }
+        if config.Labels.PythonDetails {
+                labels = append(labels, "python_details")
+        }
+        if config.Labels.ParentName {
+                labels = append(labels, "parent_name")
+        }
+        if config.Labels.Cmdline {
+                labels = append(labels, "cmdline")
+        }
+        labels = append(labels, config.envLabelNames...)
+        return labels
+}
+
+// labelValues returns the values matching labelNames for p.
+func labelValues(p sourceProcess, s *ProcessSample) []string {
+        labels := []string{}
+        if config.Labels.Cwd {
+                labels = append(labels, s.Cwd)
+        }
+        if config.Labels.ProcessName {
+                labels = append(labels, s.Name)
+        }
+        if config.Labels.Type {
+                labels = append(labels, displayType(s.Type))
+        }
+        if config.Labels.User {
+                labels = append(labels, s.User)
+        }
+        if config.Labels.ContainerRuntime {
+                labels = append(labels, containerRuntime(p.cgroup()))
+        }
+        if config.Labels.Wchan {
+                labels = append(labels, readWchan(p.pid()))
+        }
+        if config.Labels.TTY {
+                tty, _ := p.Terminal()
+                labels = append(labels, strings.TrimPrefix(tty, "/"))
+        }
+        if config.Labels.PythonDetails {
+                details := ""
+                if s.Type == "python" {
+                        details = pythonDetails(p)
+                }
+                labels = append(labels, details)
+        }
+        if config.Labels.ParentName {
+                labels = append(labels, s.Parent)
+        }
+        if config.Labels.Cmdline {
+                args, _ := p.CmdlineSlice()
+                labels = append(labels, cmdlineLabel(args))
+        }
+        if len(config.envLabelNames) > 0 {
+                env := processEnv(p)
+                for _, name := range config.envLabelNames {
+                        labels = append(labels, env[config.EnvLabels[name]])
+                }
+        }
+        if config.FlatLabels {
+                return []string{strings.Join(labels, config.LabelSeparator)}
+        }
+        return labels
+}
+
+// redactedValue replaces arguments matched by redact_args.
+const redactedValue = "<redacted>"
+
+// cmdlineLabel joins args for the cmdline label, masking them with
+// redactArgs and cutting the result to cmdline_max_length bytes.
+func cmdlineLabel(args []string) string {
+        cmdline := strings.Join(redactArgs(args), " ")
+        if n := config.CmdlineMaxLength; len(cmdline) > n {
+                // cut before a character rather than through one
+                for n > 0 && !utf8.RuneStart(cmdline[n]) {
+                        n--
+                }
+                cmdline = cmdline[:n]
+        }
+        return cmdline
+}
+
+// redactArgs returns a copy of args with those matching redact_args
+// masked. Flags stay visible and their value is masked: the part after "="
+// for "--flag=value", or the next arg for "--flag value". Other matching
+// args are masked whole.
+func redactArgs(args []string) []string {
+        masked := append([]string(nil), args...)
+        for i := 0; i < len(args); i++ {
+                arg := args[i]
+                if !redactedArg(arg) {
+                        continue
+                }
+                if flag, _, ok := strings.Cut(arg, "="); ok {
+                        masked[i] = flag + "=" + redactedValue
+                } else if strings.HasPrefix(arg, "-") {
+                        if i+1 < len(args) {
+                                i++
+                                masked[i] = redactedValue
+                        }
+                } else {
+                        masked[i] = redactedValue
+                }
+        }
+        return masked
+}
+
+// redactedArg reports whether arg matches any redact_args pattern.
+func redactedArg(arg string) bool {
+        for _, re := range config.redactArgs {
+                if re.MatchString(arg) {
+                        return true
+                }
+        }
+        return false
+}
+
+// processEnv returns p's environment as a map. Reading another user's
+// environment needs root (or CAP_SYS_PTRACE); on failure it is empty.
+func processEnv(p sourceProcess) map[string]string {
+        environ, err := p.Environ()
+        if err != nil {
+                return nil
+        }
+        env := make(map[string]string, len(environ))
+        for _, kv := range environ {
+                if k, v, ok := strings.Cut(kv, "="); ok {
+                        env[k] = v
+                }
+        }
+        return env
+}
+
+// pythonDetails describes a python process's environment: the root of its
+// virtualenv if it runs in one, otherwise the interpreter path, which
+// carries the version (/usr/bin/python3.11). The virtualenv comes from
+// VIRTUAL_ENV, or from the command line's interpreter living in a
+// directory with a pyvenv.cfg, since venvs are often used without being
+// activated. It returns "" if nothing can be read.
+func pythonDetails(p sourceProcess) string {
+        if venv := processEnv(p)["VIRTUAL_ENV"]; venv != "" {
+                return venv
+        }
+        if cmdline, err := p.CmdlineSlice(); err == nil && len(cmdline) > 0 {
+                // <venv>/bin/python3
+                if bin := filepath.Dir(cmdline[0]); filepath.Base(bin) == "bin" {
+                        root := filepath.Dir(bin)
+                        // resolved inside the process's own root, so this
+                        // works for containers and with proc_path
+                        if _, err := os.Stat(filepath.Join(procFile(p.pid(), "root"), root, "pyvenv.cfg")); err == nil {
+                                return root
+                        }
+                }
+        }
+        exe, _ := p.Exe()
+        return exe
+}
+
+// displayType maps a type to its configured display name, if any.
+func displayType(ptype string) string {
+        if name, ok := config.TypeDisplayNames[ptype]; ok {
+                return name
+        }
+        return ptype
+}
+
+func getProcessType(p processInfo) string {
+        if rule := matchTypeRules(p); rule != nil {
+                return rule.Type
+        }
+        if config.Classifier.Command != "" {
+                return externalProcessType(p, func() string { return builtinProcessType(p) })
+        }
+        return builtinProcessType(p)
+}
+
+// matchTypeRules returns the first type_rules entry matching p, or nil.
+func matchTypeRules(p processInfo) *TypeRule {
+        if len(config.TypeRules) == 0 {
+                return nil
+        }
+        name, _ := p.Name()
+        var cmdline string
+        for i := range config.TypeRules {
+                rule := &config.TypeRules[i]
+                subject := name
+                if rule.Cmdline {
+                        if cmdline == "" {
+                                cmdline, _ = p.Cmdline()
+                        }
+                        subject = cmdline
+                }
+                if rule.re.MatchString(subject) {
+                        return rule
+                }
+        }
+        return nil
+}
+
+func builtinProcessType(p processInfo) string {
+        name, _ := p.Name()
+        name = strings.ToLower(name)
+
+        switch {
+        case strings.Contains(name, "java"):
+                return "java"
+        case strings.Contains(name, "python"):
+                return "python"
+        case strings.Contains(name, "node"):
+                return "node"
+        case strings.Contains(name, "docker"), strings.Contains(name, "containerd"):
+                return "docker"
+        default:
+                // detect containers and Kubernetes pods by cgroup
+                cgroup := p.cgroup()
+                if ptype := cgroupContainerType(cgroup); ptype != "" {
+                        return ptype
+                }
+                // daemons started by systemd are named after their unit
+                if systemdUnit(cgroup) != "" {
+                        return "systemd"
+                }
+                // mark everything else as system
+                return "system"
+        }
+}
+
+// hasCgroups is false on platforms without Linux cgroups, where container
+// detection and cgroup_subtree are skipped rather than failing on /proc.
+const hasCgroups = runtime.GOOS == "linux"
+
+// hasProcfs is true where per-process files are read from proc_path
+// directly rather than through gopsutil.
+const hasProcfs = runtime.GOOS == "linux"
+
+// procRoot is proc_path, copied at startup (it can't be reloaded) so
+// /proc can be read without holding collectMu.
+var procRoot = "/proc"
+
+// procFile returns the path of a file under /proc/<pid>, relative to
+// proc_path.
+func procFile(pid int32, name string) string {
+        return filepath.Join(procRoot, strconv.Itoa(int(pid)), name)
+}
+
+// readCgroup returns the contents of /proc/<pid>/cgroup, or "" if
+// unreadable or the platform has no cgroups.
+func readCgroup(pid int32) (string, error) {
+        if !hasCgroups {
+                return "", nil
+        }
+        data, err := os.ReadFile(procFile(pid, "cgroup"))
+        if err != nil {
+                return "", err
+        }
+        return string(data), nil
+}
+
+// readWchan returns the kernel wait channel from /proc/<pid>/wchan, or ""
+// when the process is running or it can't be read.
+func readWchan(pid int32) string {
+        data, err := os.ReadFile(procFile(pid, "wchan"))
+        if err != nil {
+                return ""
+        }
+        wchan := strings.TrimSpace(string(data))
+        if wchan == "0" {
+                return ""
+        }
+        return wchan
+}
+
+// inCgroupSubtree reports whether any hierarchy in a /proc/<pid>/cgroup
+// file places the process at root or in a cgroup below it. root has no
+// trailing slash; "/" matches everything.
+func inCgroupSubtree(cgroup, root string) bool {
+        for _, line := range strings.Split(cgroup, "\n") {
+                // hierarchy-ID:controller-list:cgroup-path
+                parts := strings.SplitN(line, ":", 3)
+                if len(parts) != 3 {
+                        continue
+                }
+                path := parts[2]
+                if root == "" || path == root || strings.HasPrefix(path, root+"/") {
+                        return true
+                }
+        }
+        return false
+}
+
+// containerRuntime identifies the container runtime from cgroup paths such
+// as /docker/<id>, docker-<id>.scope, cri-containerd-<id>.scope,
+// crio-<id>.scope or libpod-<id>.scope. It returns "" for host processes.
+func containerRuntime(cgroup string) string {
+        switch {
+        case strings.Contains(cgroup, "libpod"), strings.Contains(cgroup, "podman"):
+                return "podman"
+        case strings.Contains(cgroup, "crio"):
+                return "crio"
+        case strings.Contains(cgroup, "containerd"):
+                return "containerd"
+        case strings.Contains(cgroup, "docker"):
+                return "docker"
+        default:
+                return ""
+        }
+}
+
+// cgroupContainerType classifies a /proc/<pid>/cgroup file in either the
+// cgroup v1 layout (one "id:controllers:path" line per hierarchy) or the v2
+// unified one ("0::path"). It returns "kubernetes" for pod processes,
+// "docker_app" for other containers and "" for host processes.
+func cgroupContainerType(cgroup string) string {
+        ptype := ""
+        for _, line := range strings.Split(cgroup, "\n") {
+                parts := strings.SplitN(line, ":", 3)
+                if len(parts) != 3 {
+                        continue
+                }
+                path := parts[2]
+                switch {
+                case strings.Contains(path, "kubepods"):
+                        return "kubernetes"
+                case isContainerCgroupPath(path):
+                        ptype = "docker_app"
+                }
+        }
+        return ptype
+}
+
+// isContainerCgroupPath matches the cgroupfs driver layout (/docker/<id>,
+// /containerd/<id>) and the systemd driver one (docker-<id>.scope,
+// cri-containerd-<id>.scope). Other .scope units, like login sessions, are
+// not containers.
+func isContainerCgroupPath(path string) bool {
+        for _, seg := range strings.Split(path, "/") {
+                switch {
+                case seg == "docker", seg == "containerd":
+                        return true
+                case strings.HasSuffix(seg, ".scope") && (strings.HasPrefix(seg, "docker-") || strings.Contains(seg, "containerd-")):
+                        return true
+                }
+        }
+        return false
+}
+
+// systemdUnit returns the name of the system.slice service unit in a
+// /proc/<pid>/cgroup file, without the ".service" suffix, or "" if the
+// process doesn't belong to one. Scopes, such as login sessions and
+// containers, and user units are not matched.
+func systemdUnit(cgroup string) string {
+        for _, line := range strings.Split(cgroup, "\n") {
+                parts := strings.SplitN(line, ":", 3)
+                if len(parts) != 3 {
+                        continue
+                }
+                path, ok := strings.CutPrefix(parts[2], "/system.slice/")
+                if !ok {
+                        continue
+                }
+                // template instances sit in a sub-slice, e.g.
+                // system-getty.slice/getty@tty1.service
+                for _, seg := range strings.Split(path, "/") {
+                        if strings.HasSuffix(seg, ".service") {
+                                return strings.TrimSuffix(seg, ".service")
+                        }
+                }
+        }
+        return ""
+}
+
+// unreadableName is the process name when its command line can't be read.
+const unreadableName = "(unreadable)"
+
+// getProcessName names systemd services after their unit, and other
+// processes after the first matching name_rules entry for their type, then
+// the first name_from_args flag on the command line, falling back to the
+// executable name.
+func getProcessName(p processInfo, ptype string) string {
+        name, _ := processName(p, ptype)
+        return name
+}
+
+// processName is getProcessName that also describes where the name came
+// from, for /debug/classify.
+func processName(p processInfo, ptype string) (name, source string) {
+        if ptype == "systemd" {
+                if unit := systemdUnit(p.cgroup()); unit != "" {
+                        return unit, "systemd unit"
+                }
+        }
+        cmdline, err := p.CmdlineSlice()
+        if err != nil {
+                return unreadableName, "unreadable command line"
+        }
+        if config.NameMaxArgs > 0 && len(cmdline) > config.NameMaxArgs {
+                cmdline = cmdline[:config.NameMaxArgs]
+        }
+        if len(config.NameRules) > 0 {
+                joined := strings.Join(cmdline, " ")
+                for _, rule := range config.NameRules {
+                        if rule.Type != "" && rule.Type != ptype {
+                                continue
+                        }
+                        if m := rule.re.FindStringSubmatch(joined); m != nil && m[1] != "" {
+                                return m[1], "name_rules: " + rule.Match
+                        }
+                }
+        }
+        for i, arg := range cmdline {
+                for _, flag := range config.NameFromArgs {
+                        if strings.HasSuffix(flag, "=") {
+                                if strings.HasPrefix(arg, flag) && len(arg) > len(flag) {
+                                        return arg[len(flag):], "name_from_args: " + flag
+                                }
+                        } else if arg == flag && i+1 < len(cmdline) {
+                                return cmdline[i+1], "name_from_args: " + flag
+                        }
+                }
+        }
+        name, _ = p.Name()
+        return name, "executable"
+}
+
+// isKernelThread reports whether p has an empty command line, as kernel
+// threads (and zombies) do.
+func isKernelThread(p processInfo) bool {
+        cmdline, err := p.CmdlineSlice()
+        return err == nil && len(cmdline) == 0
+}
+
+// includedType reports whether include_types lets ptype through. "all" or
+// "*" in the list matches every type.
+func includedType(ptype string) bool {
+        for _, t := range config.IncludeTypes {
+                if t == ptype || t == "all" || t == "*" {
+                        return true
+                }
+        }
+        return false
+}
+
+// userAllowed applies include_users and exclude_users to a process owner.
+// An owner that couldn't be looked up is decided by unknown_users.
+func userAllowed(username string, err error) bool {
+        if err != nil || username == "" {
+                return config.UnknownUsers == "include"
+        }
+        if contains(config.ExcludeUsers, username) {
+                return false
+        }
+        return len(config.IncludeUsers) == 0 || contains(config.IncludeUsers, username)
+}
+
+// excludedName reports whether name matches any exclude_names pattern.
+func excludedName(name string) bool {
+        for _, re := range config.excludeNames {
+                if re.MatchString(name) {
+                        return true
+                }
+        }
+        return false
+}
+
+func getWorkingDirectory(p sourceProcess) string {
+        var cwd string
+        var err error
+        if hasProcfs {
+                // through proc_path, for host PIDs seen from a container
+                cwd, err = os.Readlink(procFile(p.pid(), "cwd"))
+        } else {
+                cwd, err = p.Cwd()
+        }
+        if err != nil || cwd == "" {
+                return "(unknown)"
+        }
+        abs, err := filepath.Abs(cwd)
+        if err != nil {
+                return cwd
+        }
+        return abs
+}
+
+func collectMetrics() {
+        start := time.Now()
+        lastCollect.Store(start)
+        collectionStart.Store(start.UnixNano())
+        defer collectionStart.Store(0)
+        collectionFailed = false
+        defer func() {
+                lastCollectDone = time.Now()
+                scrapeDuration.Set(time.Since(start).Seconds())
+                if collectionFailed {
+                        scrapeErrors.Inc()
+                }
+                publishCollected()
+        }()
+
+        // with keep_missing_for, stale series are expired after the scrape
+        if config.KeepMissingFor == 0 {
+                for _, g := range processGauges() {
+                        g.Reset()
+                }
+                for _, c := range processCounters() {
+                        c.Reset()
+                }
+        }
+        if threadCPUGauge != nil {
+                threadCPUGauge.Reset()
+        }
+        if runnableGauge != nil {
+                runnableGauge.Reset()
+        }
+        if numaMemoryGauge != nil {
+                numaMemoryGauge.Reset()
+        }
+        if argCountGauge != nil {
+                argCountGauge.Reset()
+        }
+
+        // on errors the server gauges keep their previous values
+        if vm, err := mem.VirtualMemory(); err == nil {
+                serverTotalMemoryMB.Set(float64(vm.Total) / (1024 * 1024))
+                serverAvailableMemoryMB.Set(float64(vm.Available) / (1024 * 1024))
+                serverTotalMemoryBytes.Set(float64(vm.Total))
+                serverAvailableMemoryBytes.Set(float64(vm.Available))
+        } else {
+                collectionError("virtual_memory", err)
+        }
+
+        if cores, err := cpu.Counts(true); err == nil {
+                serverTotalCPUCores.Set(float64(cores))
+
+                // idle % -> available cores
+                if busyPercent, ok := hostCPUPercent(); ok {
+                        idlePercent := 100.0 - busyPercent
+                        freeCores := (idlePercent / 100.0) * float64(cores)
+                        serverAvailableCPUCores.Set(freeCores)
+                }
+        } else {
+                collectionError("cpu_counts", err)
+        }
+
+        collectCPUSteal()
+        collectLoadAvg()
+        if serverCPUCorePercent != nil {
+                collectPerCoreCPU()
+        }
+
+        if serverDiskReadBytes != nil {
+                collectDiskIO()
+        }
+
+        st := &scrapeState{
+                now:         lastCollect.Load().(time.Time),
+                selfPid:     int32(os.Getpid()),
+                running:     map[string]bool{},
+                livePids:    map[int32]bool{},
+                liveThreads: map[int32]bool{},
+                seen:        map[string][]string{},
+        }
+
+        if len(connectionsGauges) > 0 {
+                st.connections = socketTable()
+        }
+
+        procs, listErr := listProcesses()
+        if listErr != nil {
+                collectionError("process_list", listErr)
+        }
+        if !config.IncludeThreads {
+                procs = threadGroupLeaders(procs)
+        }
+        if serverProcessAge != nil {
+                serverProcessAge.Set(processAges(procs, st.now))
+        }
+        samples := sampleProcesses(procs, st)
+        processesScanned.Add(float64(len(procs)))
+        processesMatched.Set(float64(len(samples)))
+        if memoryDistribution != nil {
+                memoryDistribution.Set(memoryByType(samples))
+        }
+        // a failed listing would read as every type dropping to zero
+        if listErr == nil {
+                setTypeSummary(samples)
+        }
+        if config.AggregateChildren {
+                samples = aggregateChildren(samples)
+        }
+        for _, sample := range capSeries(topSamples(samples)) {
+                writeSample(sample, st)
+        }
+        if listErr == nil {
+                lastSamples.Store(&samples)
+        }
+
+        if config.KeepMissingFor > 0 {
+                expireMissingSeries(st.seen)
+        }
+        if serverNearFDLimit != nil {
+                serverNearFDLimit.Set(float64(st.nearFDLimit))
+        }
+
+        for pid := range processCPUPrev {
+                if !st.livePids[pid] {
+                        delete(processCPUPrev, pid)
+                }
+        }
+        for pid := range cpuEWMA {
+                if !st.livePids[pid] {
+                        delete(cpuEWMA, pid)
+                }
+        }
+        for pid := range rssHistory {
+                if !st.livePids[pid] {
+                        delete(rssHistory, pid)
+                }
+        }
+        for tid := range threadCPUPrev {
+                if !st.liveThreads[tid] {
+                        delete(threadCPUPrev, tid)
+                }
+        }
+
+        if processUpGauge != nil {
+                for _, name := range config.WatchNames {
+                        up := 0.0
+                        if st.running[name] {
+                                up = 1
+                        }
+                        processUpGauge.WithLabelValues(name).Set(up)
+                }
+        }
+
+        if listErr == nil {
+                lastScrape.Store(&scrapeSummary{at: time.Now(), processes: len(samples)})
+        }
+        slog.Debug("collection finished", "scanned", len(procs), "matched", len(samples), "duration", time.Since(start))
+}
+
+// sampleProcesses classifies and filters procs and returns a sample for
+// each process that matched, in procs order.
+func sampleProcesses(procs []sourceProcess, st *scrapeState) []*ProcessSample {
+        if config.ParentNameFilter != "" {
+                st.names = make(map[int32]string, len(procs))
+                for _, p := range procs {
+                        if name, err := p.Name(); err == nil {
+                                st.names[p.pid()] = name
+                        }
+                }
+        }
+        // results are indexed like procs, so samples come out in the same
+        // order whatever the number of workers
+        results := make([]*ProcessSample, len(procs))
+        if config.CollectionWorkers <= 1 {
+                for i, p := range procs {
+                        results[i] = sampleProcessSafe(p, st)
+                }
+        } else {
+                next := make(chan int)
+                var wg sync.WaitGroup
+                for w := 0; w < config.CollectionWorkers; w++ {
+                        wg.Add(1)
+                        go func() {
+                                defer wg.Done()
+                                for i := range next {
+                                        results[i] = sampleProcessSafe(procs[i], st)
+                                }
+                        }()
+                }
+                for i := range procs {
+                        next <- i
+                }
+                close(next)
+                wg.Wait()
+        }
+        samples := []*ProcessSample{}
+        for _, sample := range results {
+                if sample != nil {
+                        samples = append(samples, sample)
+                }
+        }
+
+        live := make(map[int32]bool, len(procs))
+        for _, p := range procs {
+                live[p.pid()] = true
+        }
+        pruneIdentityCache(live)
+        if config.Classifier.Command != "" {
+                pruneClassifierCache(live)
+        }
+        return samples
+}
+
+// stateMu guards the per-PID history maps (processCPUPrev, cpuEWMA,
+// rssHistory, threadCPUPrev, identityCache) and the scrapeState maps and
+// counters while collection workers sample processes in parallel. It is
+// only held for map updates, never across /proc reads.
+var stateMu sync.Mutex
+
+// scrapeState is the per-scrape bookkeeping shared by sampleProcess calls.
+// Its maps and counters are written under stateMu.
+type scrapeState struct {
+        now     time.Time
+        selfPid int32
+        // watched names seen this scrape, regardless of type filtering
+        running     map[string]bool
+        livePids    map[int32]bool
+        liveThreads map[int32]bool
+        // label values reported this scrape, keyed by seriesKey
+        seen map[string][]string
+        // matched processes close to their FD limit
+        nearFDLimit int
+        // pid -> process name, only built when parent_name_filter is set
+        names map[int32]string
+        // pid -> socket counts by state, only built with metrics.connections
+        connections map[int32]map[string]int
+        // ppid -> parent name, filled in as parent_name labels are looked up
+        parentNames map[int32]string
+}
+
+// noParent is the parent_name label value when the parent has exited or
+// can't be read.
+const noParent = "(none)"
+
+// parentName names p's parent the same way p itself would be named. Many
+// workers share a parent, so names are remembered for the rest of the
+// scrape.
+func parentName(p sourceProcess, st *scrapeState) string {
+        ppid, err := p.Ppid()
+        if err != nil || ppid == 0 {
+                return noParent
+        }
+        stateMu.Lock()
+        name, ok := st.parentNames[ppid]
+        stateMu.Unlock()
+        if ok {
+                return name
+        }
+        name = noParent
+        if parent, err := lookupProcess(ppid); err == nil {
+                if id, err := processIdentity(parent); err == nil {
+                        name = id.name
+                }
+        }
+        stateMu.Lock()
+        if st.parentNames == nil {
+                st.parentNames = map[int32]string{}
+        }
+        st.parentNames[ppid] = name
+        stateMu.Unlock()
+        return name
+}
+
+// aboveThreshold reports whether a process reaches min_memory_mb or
+// min_cpu_percent. A threshold left at 0 is not considered, so with only
+// one set it alone decides.
+func aboveThreshold(memoryMB, cpuPercent float64) bool {
+        return (config.MinMemoryMB > 0 && memoryMB >= config.MinMemoryMB) ||
+                (config.MinCPUPercent > 0 && cpuPercent >= config.MinCPUPercent)
+}
+
+// ProcessSample is what one scrape collected for a single matched process.
+// Its JSON form is served on /snapshot.
+type ProcessSample struct {
+        Pid        int32    `json:"pid"`
+        Type       string   `json:"type"`
+        Name       string   `json:"name"`
+        Cwd        string   `json:"cwd"`
+        User       string   `json:"user"`
+        Parent     string   `json:"parent,omitempty"`
+        Labels     []string `json:"-"`
+        MemoryMB   float64  `json:"memory_mb"`
+        CPUPercent float64  `json:"cpu_percent"`
+        // optional per-process gauges and counters that produced a value
+        Gauges   map[*prometheus.GaugeVec]float64   `json:"-"`
+        Counters map[*prometheus.CounterVec]float64 `json:"-"`
+        // only read with aggregate_children
+        ppid int32
+}
+
+// sampleProcessSafe runs sampleProcess, turning a panic (gopsutil has been
+// seen to panic on malformed /proc data) into a log line and a counter bump
+// so one bad process can't take down the whole scrape.
+func sampleProcessSafe(p sourceProcess, st *scrapeState) (sample *ProcessSample) {
+        defer func() {
+                if r := recover(); r != nil {
+                        collectionPanics.Inc()
+                        slog.Error("recovered from panic collecting process", "pid", p.pid(), "panic", r)
+                        sample = nil
+                }
+        }()
+        return sampleProcess(p, st)
+}
+
+// earlyFilter returns the process_scout_filtered_total filter that drops p
+// before it is classified, or "" if none does.
+func earlyFilter(p filterSubject, st *scrapeState) string {
+        if config.ExcludeSelf && p.pid() == st.selfPid {
+                return "exclude_self"
+        }
+        if config.SkipKernelThreads && isKernelThread(p) {
+                return "kernel_threads"
+        }
+        return ""
+}
+
+// classifiedFilter returns the filter that drops p given its type and
+// name, or "" if p is collected. Filters are checked in a fixed order and
+// the first match is reported.
+func classifiedFilter(p filterSubject, ptype, name string, st *scrapeState) string {
+        if !includedType(ptype) {
+                return "include_types"
+        }
+        // excludes win over include_types
+        if contains(config.ExcludeTypes, ptype) {
+                return "exclude_types"
+        }
+        if len(config.excludeNames) > 0 && excludedName(name) {
+                return "exclude_names"
+        }
+        if len(config.IncludeUsers) > 0 || len(config.ExcludeUsers) > 0 {
+                if !userAllowed(p.Username()) {
+                        return "users"
+                }
+        }
+        if config.CgroupSubtree != "" {
+                if !inCgroupSubtree(p.cgroup(), config.CgroupSubtree) {
+                        return "cgroup_subtree"
+                }
+        }
+        if config.ParentNameFilter != "" {
+                ppid, err := p.Ppid()
+                if err != nil || st.names[ppid] != config.ParentNameFilter {
+                        return "parent_name"
+                }
+        }
+        return ""
+}
+
+// sampleProcess classifies and filters p and reads its metrics. It returns
+// nil when the process is filtered out or its memory can't be read.
+func sampleProcess(p sourceProcess, st *scrapeState) *ProcessSample {
+        if filter := earlyFilter(p, st); filter != "" {
+                filteredTotal.WithLabelValues(filter).Inc()
+                return nil
+        }
+        id, err := processIdentity(p)
+        if err != nil {
+                // exited since the process list was read
+                return nil
+        }
+        ptype, name := id.ptype, id.name
+        if len(config.WatchNames) > 0 {
+                if isWatched(name) {
+                        stateMu.Lock()
+                        st.running[name] = true
+                        stateMu.Unlock()
+                        if threadCPUGauge != nil {
+                                collectThreadCPU(p, name, st.now, st.liveThreads)
+                        }
+                        if runnableGauge != nil {
+                                if n, err := countRunnableThreads(p.pid()); err == nil {
+                                        runnableGauge.WithLabelValues(name, fmt.Sprint(p.pid())).Set(float64(n))
+                                }
+                        }
+                        if argCountGauge != nil {
+                                if args, err := p.CmdlineSlice(); err == nil {
+                                        argCountGauge.WithLabelValues(name, fmt.Sprint(p.pid())).Set(float64(len(args)))
+                                }
+                        }
+                        if numaMemoryGauge != nil {
+                                if nodes, err := numaMemory(p.pid()); err == nil {
+                                        for node, bytes := range nodes {
+                                                numaMemoryGauge.WithLabelValues(name, fmt.Sprint(p.pid()), node).Set(float64(bytes) / (1024 * 1024))
+                                        }
+                                }
+                        }
+                }
+        }
+        if filter := classifiedFilter(p, ptype, name, st); filter != "" {
+                filteredTotal.WithLabelValues(filter).Inc()
+                return nil
+        }
+
+        // a process that exits mid-scrape fails here too, which isn't an error
+        memInfo, err := p.MemoryInfo()
+        if err != nil {
+                if !processGone(err) {
+                        collectionErrors.WithLabelValues("memory_info").Inc()
+                }
+                return nil
+        }
+        cpuPercent, err := processCPUPercent(p, st.now)
+        if err != nil {
+                if !processGone(err) {
+                        collectionErrors.WithLabelValues("cpu_times").Inc()
+                }
+                return nil
+        }
+
+        // per-PID state (CPU deltas, smoothing, leak detection) is kept
+        // while this is set, even for processes under the thresholds
+        stateMu.Lock()
+        st.livePids[p.pid()] = true
+        stateMu.Unlock()
+
+        memoryMB := float64(memInfo.RSS) / (1024 * 1024)
+        if (config.MinMemoryMB > 0 || config.MinCPUPercent > 0) && !aboveThreshold(memoryMB, cpuPercent) {
+                filteredTotal.WithLabelValues("thresholds").Inc()
+                return nil
+        }
+
+        username, _ := p.Username()
+        sample := &ProcessSample{
+                Pid:        p.pid(),
+                Type:       ptype,
+                Name:       name,
+                Cwd:        id.cwd,
+                User:       username,
+                MemoryMB:   memoryMB,
+                CPUPercent: cpuPercent,
+                Gauges:     map[*prometheus.GaugeVec]float64{},
+                Counters:   map[*prometheus.CounterVec]float64{},
+        }
+        if config.Labels.ParentName {
+                sample.Parent = parentName(p, st)
+        }
+        sample.Labels = labelValues(p, sample)
+        if config.AggregateChildren {
+                sample.ppid, _ = p.Ppid()
+        }
+
+        if rssGauge != nil {
+                sample.Gauges[rssGauge] = float64(memInfo.RSS) / (1024 * 1024)
+        }
+        if vmsGauge != nil {
+                sample.Gauges[vmsGauge] = float64(memInfo.VMS) / (1024 * 1024)
+        }
+        if swapGauge != nil {
+                sample.Gauges[swapGauge] = float64(memInfo.Swap) / (1024 * 1024)
+        }
+
+        if st.connections != nil {
+                counts := st.connections[p.pid()]
+                for i, state := range connectionStates {
+                        sample.Gauges[connectionsGauges[i]] = float64(counts[state])
+                }
+        }
+
+        if len(smoothedCPUGauges) > 0 {
+                for i, v := range smoothCPU(p, cpuPercent, st.now) {
+                        sample.Gauges[smoothedCPUGauges[i]] = v
+                }
+        }
+
+        if sharedMemoryGauge != nil {
+                if memEx, err := p.MemoryInfoEx(); err == nil {
+                        sample.Gauges[sharedMemoryGauge] = float64(memEx.Shared) / (1024 * 1024)
+                }
+        }
+
+        if mappedFilesGauge != nil {
+                if n, err := countMappedFiles(p.pid()); err == nil {
+                        sample.Gauges[mappedFilesGauge] = float64(n)
+                }
+        }
+
+        if realtimeGauge != nil {
+                if policy, err := schedPolicy(p.pid()); err == nil {
+                        rt := 0.0
+                        if policy == schedFIFO || policy == schedRR {
+                                rt = 1
+                        }
+                        sample.Gauges[realtimeGauge] = rt
+                }
+        }
+
+        if leakGauge != nil {
+                createTime, _ := p.CreateTime()
+                suspected := 0.0
+                if leakSuspected(p.pid(), createTime, sample.MemoryMB, st.now) {
+                        suspected = 1
+                }
+                sample.Gauges[leakGauge] = suspected
+        }
+
+        if exeDeletedGauge != nil {
+                if exe, err := os.Readlink(procFile(p.pid(), "exe")); err == nil {
+                        deleted := 0.0
+                        if strings.HasSuffix(exe, " (deleted)") {
+                                deleted = 1
+                        }
+                        sample.Gauges[exeDeletedGauge] = deleted
+                }
+        }
+
+        if serverNearFDLimit != nil && nearFDLimit(p) {
+                stateMu.Lock()
+                st.nearFDLimit++
+                stateMu.Unlock()
+        }
+
+        if memoryLimitGauge != nil {
+                if limit, ok := softRlimit(p, process.RLIMIT_AS); ok {
+                        sample.Gauges[memoryLimitGauge] = float64(limit) / (1024 * 1024)
+                }
+        }
+
+        // absent when the flag isn't given, as the JVM then sizes the heap itself
+        if jvmMaxHeapGauge != nil && ptype == "java" {
+                if args, err := p.CmdlineSlice(); err == nil {
+                        if mb, ok := jvmHeapFlag(args, "-Xmx"); ok {
+                                sample.Gauges[jvmMaxHeapGauge] = mb
+                        }
+                        if mb, ok := jvmHeapFlag(args, "-Xms"); ok {
+                                sample.Gauges[jvmMinHeapGauge] = mb
+                        }
+                }
+        }
+
+        // NumFDs isn't supported everywhere; skip rather than report 0
+        if openFDsGauge != nil {
+                if fds, err := p.NumFDs(); err == nil {
+                        sample.Gauges[openFDsGauge] = float64(fds)
+                        if limit, ok := softRlimit(p, process.RLIMIT_NOFILE); ok {
+                                sample.Gauges[fdLimitGauge] = float64(limit)
+                        }
+                }
+        }
+
+        if numThreadsGauge != nil {
+                if n, err := p.NumThreads(); err == nil {
+                        sample.Gauges[numThreadsGauge] = float64(n)
+                }
+                if ctx, err := p.NumCtxSwitches(); err == nil {
+                        sample.Gauges[voluntaryCtxGauge] = float64(ctx.Voluntary)
+                        sample.Gauges[involuntaryCtxGauge] = float64(ctx.Involuntary)
+                }
+        }
+
+        if minorFaultsCounter != nil {
+                if faults, err := p.PageFaults(); err == nil {
+                        sample.Counters[minorFaultsCounter] = float64(faults.MinorFaults)
+                        sample.Counters[majorFaultsCounter] = float64(faults.MajorFaults)
+                }
+        }
+
+        if lastSeenGauge != nil {
+                sample.Gauges[lastSeenGauge] = float64(st.now.UnixNano()) / 1e9
+        }
+
+        if startTimeGauge != nil {
+                // CreateTime is in milliseconds
+                if createTime, err := p.CreateTime(); err == nil {
+                        sample.Gauges[startTimeGauge] = float64(createTime) / 1000
+                }
+        }
+        return sample
+}
+
+// writeSample publishes a sample to the per-process gauges.
+func writeSample(s *ProcessSample, st *scrapeState) {
+        memoryGauge.WithLabelValues(s.Labels...).Set(s.MemoryMB)
+        cpuGauge.WithLabelValues(s.Labels...).Set(s.CPUPercent)
+        for g, v := range s.Gauges {
+                g.WithLabelValues(s.Labels...).Set(v)
+        }
+        // counters carry the kernel's cumulative value as-is, as for disk I/O
+        for c, v := range s.Counters {
+                c.DeleteLabelValues(s.Labels...)
+                c.WithLabelValues(s.Labels...).Add(v)
+        }
+        st.seen[seriesKey(s.Labels)] = s.Labels
+}
+
+// aggregateChildren folds each sample whose parent is a sample with the
+// same name and type into that parent, recursively, so a pre-fork server
+// reports as one process. Memory and CPU are summed; optional gauges keep
+// the root's own values. A process whose parent has exited is its own root.
+func aggregateChildren(samples []*ProcessSample) []*ProcessSample {
+        byPid := make(map[int32]*ProcessSample, len(samples))
+        for _, s := range samples {
+                byPid[s.Pid] = s
+        }
+        root := func(s *ProcessSample) *ProcessSample {
+                for {
+                        parent, ok := byPid[s.ppid]
+                        if !ok || parent == s || parent.Name != s.Name || parent.Type != s.Type {
+                                return s
+                        }
+                        s = parent
+                }
+        }
+
+        roots := make([]*ProcessSample, 0, len(samples))
+        for _, s := range samples {
+                r := root(s)
+                if r == s {
+                        roots = append(roots, s)
+                        continue
+                }
+                // only roots are modified, so s still holds its own values
+                r.MemoryMB += s.MemoryMB
+                r.CPUPercent += s.CPUPercent
+        }
+        return roots
+}
+
+// topSamples keeps the top_n samples ranked by top_by, breaking ties by
+// PID so the selection is stable between scrapes. It sorts a copy, so
+// samples keeps its order for /snapshot.
+func topSamples(samples []*ProcessSample) []*ProcessSample {
+        if config.TopN <= 0 || len(samples) <= config.TopN {
+                return samples
+        }
+        key := func(s *ProcessSample) float64 { return s.MemoryMB }
+        if config.TopBy == "cpu" {
+                key = func(s *ProcessSample) float64 { return s.CPUPercent }
+        }
+        ranked := append([]*ProcessSample(nil), samples...)
+        sort.Slice(ranked, func(i, j int) bool {
+                ki, kj := key(ranked[i]), key(ranked[j])
+                if ki != kj {
+                        return ki > kj
+                }
+                return ranked[i].Pid < ranked[j].Pid
+        })
+        return ranked[:config.TopN]
+}
+
+// processCounters returns the registered counters labelled per process.
+func processCounters() []*prometheus.CounterVec {
+        var counters []*prometheus.CounterVec
+        for _, c := range []*prometheus.CounterVec{minorFaultsCounter, majorFaultsCounter} {
+                if c != nil {
+                        counters = append(counters, c)
+                }
+        }
+        return counters
+}
+
+// processGauges returns the registered vectors labelled per process.
+func processGauges() []*prometheus.GaugeVec {
+        gauges := []*prometheus.GaugeVec{memoryGauge, cpuGauge}
+        gauges = append(gauges, smoothedCPUGauges...)
+        gauges = append(gauges, connectionsGauges...)
+        for _, g := range []*prometheus.GaugeVec{rssGauge, vmsGauge, swapGauge, sharedMemoryGauge, mappedFilesGauge, realtimeGauge, memoryLimitGauge, exeDeletedGauge, openFDsGauge, fdLimitGauge, numThreadsGauge, voluntaryCtxGauge, involuntaryCtxGauge, startTimeGauge, lastSeenGauge, leakGauge, jvmMaxHeapGauge, jvmMinHeapGauge} {
+                if g != nil {
+                        gauges = append(gauges, g)
+                }
+        }
+        return gauges
+}
+
+// overflowLabel is the value of every label on the max_series overflow series.
+const overflowLabel = "(overflow)"
+
+// capSeries keeps samples for at most max_series distinct label sets and
+// sums the memory and CPU of the rest into a single overflow series.
+// Optional gauges aren't meaningful summed and are dropped for those.
+func capSeries(samples []*ProcessSample) []*ProcessSample {
+        if config.MaxSeries == 0 {
+                return samples
+        }
+        seen := make(map[string]bool, config.MaxSeries)
+        kept := make([]*ProcessSample, 0, len(samples))
+        var overflow *ProcessSample
+        overflowed := 0
+        for _, s := range samples {
+                key := seriesKey(s.Labels)
+                if seen[key] || len(seen) < config.MaxSeries {
+                        seen[key] = true
+                        kept = append(kept, s)
+                        continue
+                }
+                if overflow == nil {
+                        labels := make([]string, len(s.Labels))
+                        for i := range labels {
+                                labels[i] = overflowLabel
+                        }
+                        overflow = &ProcessSample{Labels: labels, Gauges: map[*prometheus.GaugeVec]float64{}}
+                }
+                overflow.MemoryMB += s.MemoryMB
+                overflow.CPUPercent += s.CPUPercent
+                overflowed++
+        }
+        if overflow != nil {
+                slog.Warn("max_series exceeded, aggregating the rest into the overflow series", "max_series", config.MaxSeries, "processes", overflowed)
+                kept = append(kept, overflow)
+        }
+        return kept
+}
+
+func seriesKey(labels []string) string {
+        return strings.Join(labels, "\xff")
+}
+
+// missedScrapes counts, per series, how many consecutive scrapes it has
+// not been reported in.
+var missedScrapes = map[string]int{}
+
+// expireMissingSeries keeps a series that was not reported this scrape at
+// its last value until it has been missing for more than keep_missing_for
+// scrapes, then deletes it from every per-process gauge.
+func expireMissingSeries(seen map[string][]string) {
+        for key := range seen {
+                missedScrapes[key] = 0
+        }
+        for key, missed := range missedScrapes {
+                if _, ok := seen[key]; ok {
+                        continue
+                }
+                missed++
+                if missed <= config.KeepMissingFor {
+                        missedScrapes[key] = missed
+                        continue
+                }
+                labels := strings.Split(key, "\xff")
+                for _, g := range processGauges() {
+                        g.DeleteLabelValues(labels...)
+                }
+                for _, c := range processCounters() {
+                        c.DeleteLabelValues(labels...)
+                }
+                delete(missedScrapes, key)
+        }
+}
+
+// cpuTimeSample is a process's cumulative CPU time at a point in time.
+type cpuTimeSample struct {
+        createTime int64
+        seconds    float64
+        at         time.Time
+}
+
+// processCPUPrev holds the previous sample per PID so process CPU usage is
+// measured over the interval between scrapes.
+var processCPUPrev = map[int32]cpuTimeSample{}
+
+// processCPUPercent returns p's CPU usage since the previous scrape. With no
+// usable previous sample (first scrape of the process, or a recycled PID)
+// it falls back to the average over the process's lifetime.
+func processCPUPercent(p sourceProcess, now time.Time) (float64, error) {
+        times, err := p.Times()
+        if err != nil {
+                return 0, err
+        }
+        createTime, _ := p.CreateTime()
+        cur := cpuTimeSample{createTime: createTime, seconds: times.User + times.System, at: now}
+        percent, ok := cpuPercentSincePrev(p.pid(), cur)
+        if !ok {
+                if percent, err = p.CPUPercent(); err != nil {
+                        return 0, err
+                }
+        }
+        stateMu.Lock()
+        processCPUPrev[p.pid()] = cur
+        stateMu.Unlock()
+        return percent, nil
+}
+
+// cpuPercentSincePrev returns the CPU usage between pid's sample from the
+// previous scrape and cur, or false if there is no usable previous sample.
+// It doesn't record cur, so callers outside a collection don't disturb the
+// next one.
+func cpuPercentSincePrev(pid int32, cur cpuTimeSample) (float64, bool) {
+        stateMu.Lock()
+        prev, ok := processCPUPrev[pid]
+        stateMu.Unlock()
+        if ok && prev.createTime == cur.createTime {
+                elapsed := cur.at.Sub(prev.at).Seconds()
+                if elapsed > 0 && cur.seconds >= prev.seconds {
+                        return (cur.seconds - prev.seconds) / elapsed * 100, true
+                }
+        }
+        return 0, false
+}
+
+// ewmaState is the smoothed CPU per window for one process. createTime
+// guards against a recycled PID inheriting another process's history.
+type ewmaState struct {
+        createTime int64
+        at         time.Time
+        values     []float64
+}
+
+var cpuEWMA = map[int32]*ewmaState{}
+
+// smoothCPU folds the latest CPU sample into each window's exponentially
+// weighted moving average. The decay depends on the time since the previous
+// scrape, so irregular scrape intervals are weighted correctly.
+func smoothCPU(p sourceProcess, cpuPercent float64, now time.Time) []float64 {
+        createTime, _ := p.CreateTime()
+        stateMu.Lock()
+        defer stateMu.Unlock()
+        st, ok := cpuEWMA[p.pid()]
+        if !ok || st.createTime != createTime {
+                st = &ewmaState{createTime: createTime, at: now, values: make([]float64, len(config.CPUSmoothingWindows))}
+                for i := range st.values {
+                        st.values[i] = cpuPercent
+                }
+                cpuEWMA[p.pid()] = st
+                return st.values
+        }
+
+        dt := now.Sub(st.at).Seconds()
+        st.at = now
+        for i, w := range config.CPUSmoothingWindows {
+                alpha := 1 - math.Exp(-dt/w.Seconds())
+                st.values[i] += alpha * (cpuPercent - st.values[i])
+        }
+        return st.values
+}
+
+// rssSample is one RSS reading for leak detection.
+type rssSample struct {
+        at    time.Time
+        rssMB float64
+}
+
+// rssRing is a per-process ring buffer of the most recent RSS readings.
+type rssRing struct {
+        createTime int64
+        samples    []rssSample
+        next       int
+        full       bool
+}
+
+var rssHistory = map[int32]*rssRing{}
+
+// leakSuspected records the latest RSS for pid and reports whether the
+// last leak_detection.samples readings grow monotonically at an average
+// rate of at least min_growth_mb_per_hour.
+func leakSuspected(pid int32, createTime int64, rssMB float64, now time.Time) bool {
+        n := config.LeakDetection.Samples
+        stateMu.Lock()
+        defer stateMu.Unlock()
+        ring, ok := rssHistory[pid]
+        if !ok || ring.createTime != createTime {
+                ring = &rssRing{createTime: createTime, samples: make([]rssSample, n)}
+                rssHistory[pid] = ring
+        }
+        ring.samples[ring.next] = rssSample{at: now, rssMB: rssMB}
+        ring.next = (ring.next + 1) % n
+        if ring.next == 0 {
+                ring.full = true
+        }
+        if !ring.full {
+                return false
+        }
+
+        // oldest reading is at ring.next
+        prev := ring.samples[ring.next]
+        for i := 1; i < n; i++ {
+                cur := ring.samples[(ring.next+i)%n]
+                if cur.rssMB <= prev.rssMB {
+                        return false
+                }
+                prev = cur
+        }
+        first := ring.samples[ring.next]
+        hours := prev.at.Sub(first.at).Hours()
+        return hours > 0 && (prev.rssMB-first.rssMB)/hours >= config.LeakDetection.MinGrowthMBPerHour
+}
+
+// windowSuffix turns a window into a metric name suffix: 1m, 5m, 30s, 1h.
+func windowSuffix(d time.Duration) string {
+        switch {
+        case d%time.Hour == 0:
+                return fmt.Sprintf("%dh", d/time.Hour)
+        case d%time.Minute == 0:
+                return fmt.Sprintf("%dm", d/time.Minute)
+        default:
+                return fmt.Sprintf("%ds", d/time.Second)
+        }
+}
+
+// softRlimit returns the soft limit for resource. ok is false when the
+// limits can't be read or the resource is unlimited.
+func softRlimit(p sourceProcess, resource int32) (limit uint64, ok bool) {
+        limits, err := p.Rlimit()
+        if err != nil {
+                return 0, false
+        }
+        for _, l := range limits {
+                if l.Resource == resource {
+                        // RLIM_INFINITY
+                        if l.Soft >= math.MaxInt64 {
+                                return 0, false
+                        }
+                        return l.Soft, true
+                }
+        }
+        return 0, false
+}
+
+// threadGroupLeaders drops tasks that are threads of another process
+// (Tgid != Pid) so their CPU and memory aren't counted twice.
+func threadGroupLeaders(procs []sourceProcess) []sourceProcess {
+        leaders := procs[:0]
+        for _, p := range procs {
+                if tgid, err := p.Tgid(); err == nil && tgid != p.pid() {
+                        continue
+                }
+                leaders = append(leaders, p)
+        }
+        return leaders
+}
+
+// jvmHeapFlag returns the size in MB given by a JVM heap flag such as
+// -Xmx2g. As with the JVM the last occurrence wins; arguments after -jar
+// belong to the application and are ignored.
+func jvmHeapFlag(args []string, flag string) (float64, bool) {
+        mb, found := 0.0, false
+        for _, arg := range args {
+                if arg == "-jar" {
+                        break
+                }
+                value, ok := strings.CutPrefix(arg, flag)
+                if !ok {
+                        continue
+                }
+                if bytes, ok := parseJVMSize(value); ok {
+                        mb, found = bytes/(1024*1024), true
+                }
+        }
+        return mb, found
+}
+
+// parseJVMSize parses a JVM memory size: bytes, or a number with a
+// k, m, g or t suffix (either case).
+func parseJVMSize(s string) (float64, bool) {
+        multiplier := 1.0
+        if s != "" {
+                switch s[len(s)-1] {
+                case 'k', 'K':
+                        multiplier = 1 << 10
+                case 'm', 'M':
+                        multiplier = 1 << 20
+                case 'g', 'G':
+                        multiplier = 1 << 30
+                case 't', 'T':
+                        multiplier = 1 << 40
+                }
+                if multiplier != 1 {
+                        s = s[:len(s)-1]
+                }
+        }
+        n, err := strconv.ParseUint(s, 10, 64)
+        if err != nil {
+                return 0, false
+        }
+        return float64(n) * multiplier, true
+}
+
+// setTypeSummary publishes the count and total RSS of the matched
+// processes per type, before top_n and max_series. Types named in
+// include_types report 0 when none are running, so an alert can tell "no
+// java processes" from a missing series.
+func setTypeSummary(samples []*ProcessSample) {
+        processCountByType.Reset()
+        processMemoryByType.Reset()
+        for _, t := range config.IncludeTypes {
+                if t != "all" && t != "*" {
+                        processCountByType.WithLabelValues(displayType(t)).Set(0)
+                        processMemoryByType.WithLabelValues(displayType(t)).Set(0)
+                }
+        }
+        for t, mems := range memoryByType(samples) {
+                total := 0.0
+                for _, mb := range mems {
+                        total += mb
+                }
+                processCountByType.WithLabelValues(t).Set(float64(len(mems)))
+                processMemoryByType.WithLabelValues(t).Set(total)
+        }
+}
+
+// memoryByType groups the RSS of each sample by its exported type label.
+func memoryByType(samples []*ProcessSample) map[string][]float64 {
+        byType := map[string][]float64{}
+        for _, s := range samples {
+                t := displayType(s.Type)
+                byType[t] = append(byType[t], s.MemoryMB)
+        }
+        return byType
+}
+
+// processAges returns the age in seconds of every process that still exists.
+func processAges(procs []sourceProcess, now time.Time) []float64 {
+        ages := make([]float64, 0, len(procs))
+        for _, p := range procs {
+                createTime, err := p.CreateTime()
+                if err != nil {
+                        continue
+                }
+                ages = append(ages, now.Sub(time.UnixMilli(createTime)).Seconds())
+        }
+        return ages
+}
+
+// nearFDLimit reports whether p has more open FDs than fd_limit_ratio of
+// its soft RLIMIT_NOFILE.
+func nearFDLimit(p sourceProcess) bool {
+        limit, ok := softRlimit(p, process.RLIMIT_NOFILE)
+        if !ok || limit == 0 {
+                return false
+        }
+        fds, err := p.NumFDs()
+        if err != nil {
+                return false
+        }
+        return float64(fds) > config.FDLimitRatio*float64(limit)
+}
+
+// readStatFields returns the fields of a /proc stat file that follow the
+// parenthesised command name, so index 0 is the state (field 3 in proc(5)).
+// The command name may itself contain spaces and parentheses.
+func readStatFields(path string) ([]string, error) {
+        data, err := os.ReadFile(path)
+        if err != nil {
+                return nil, err
+        }
+        stat := string(data)
+        end := strings.LastIndexByte(stat, ')')
+        if end < 0 {
+                return nil, fmt.Errorf("%s: malformed stat line", path)
+        }
+        return strings.Fields(stat[end+1:]), nil
+}
+
+// scheduling policies from sched(7)
+const (
+        schedFIFO = 1
+        schedRR   = 2
+)
+
+// schedPolicy returns the scheduling policy (field 41 of /proc/<pid>/stat).
+func schedPolicy(pid int32) (int, error) {
+        fields, err := readStatFields(procFile(pid, "stat"))
+        if err != nil {
+                return 0, err
+        }
+        if len(fields) < 39 {
+                return 0, fmt.Errorf("pid %d: stat has no policy field", pid)
+        }
+        return strconv.Atoi(fields[38])
+}
+
+// countRunnableThreads counts the threads in /proc/<pid>/task whose state
+// is R (running or runnable).
+func countRunnableThreads(pid int32) (int, error) {
+        taskDir := procFile(pid, "task")
+        tasks, err := os.ReadDir(taskDir)
+        if err != nil {
+                return 0, err
+        }
+        runnable := 0
+        for _, task := range tasks {
+                fields, err := readStatFields(filepath.Join(taskDir, task.Name(), "stat"))
+                if err != nil || len(fields) == 0 {
+                        // thread exited while we were scanning
+                        continue
+                }
+                if fields[0] == "R" {
+                        runnable++
+                }
+        }
+        return runnable, nil
+}
+
+// numaMemory sums the pages each NUMA node holds for the process, from the
+// N<node>=<pages> fields of /proc/<pid>/numa_maps, and returns bytes per
+// node ("0", "1", ...).
+func numaMemory(pid int32) (map[string]uint64, error) {
+        f, err := os.Open(procFile(pid, "numa_maps"))
+        if err != nil {
+                return nil, err
+        }
+        defer f.Close()
+
+        nodes := map[string]uint64{}
+        scanner := bufio.NewScanner(f)
+        for scanner.Scan() {
+                pageSize := uint64(4096)
+                pages := map[string]uint64{}
+                for _, field := range strings.Fields(scanner.Text()) {
+                        key, value, ok := strings.Cut(field, "=")
+                        if !ok {
+                                continue
+                        }
+                        n, err := strconv.ParseUint(value, 10, 64)
+                        if err != nil {
+                                continue
+                        }
+                        switch {
+                        case key == "kernelpagesize_kB":
+                                pageSize = n * 1024
+                        case len(key) > 1 && key[0] == 'N':
+                                pages[key[1:]] += n
+                        }
+                }
+                for node, n := range pages {
+                        nodes[node] += n * pageSize
+                }
+        }
+        return nodes, scanner.Err()
+}
+
+// connectionStates are the process_connections state label values; sockets
+// in any other state (including UDP, which has none) count as OTHER.
+// TIME_WAIT sockets are left out: the kernel keeps them after the owning
+// process has closed them, so they belong to no process.
+var connectionStates = []string{"ESTABLISHED", "LISTEN", "CLOSE_WAIT", "OTHER"}
+
+// socketTable reads the system-wide TCP and UDP socket table once and
+// counts sockets per PID and state. It returns nil if the table can't be
+// read. Sockets of processes whose /proc/<pid>/fd isn't readable are
+// missing from the table rather than failing the read.
+func socketTable() map[int32]map[string]int {
+        conns, err := psnet.Connections("inet")
+        if err != nil {
+                collectionError("connections", err)
+                return nil
+        }
+        table := map[int32]map[string]int{}
+        for _, c := range conns {
+                if c.Pid == 0 {
+                        continue
+                }
+                state := c.Status
+                if !contains(connectionStates, state) {
+                        state = "OTHER"
+                }
+                if table[c.Pid] == nil {
+                        table[c.Pid] = map[string]int{}
+                }
+                table[c.Pid][state]++
+        }
+        return table
+}
+
+// countMappedFiles counts the distinct file-backed mappings listed in
+// /proc/<pid>/maps. Anonymous and pseudo mappings ([heap], [stack], ...)
+// are ignored.
+func countMappedFiles(pid int32) (int, error) {
+        f, err := os.Open(procFile(pid, "maps"))
+        if err != nil {
+                return 0, err
+        }
+        defer f.Close()
+
+        files := map[string]struct{}{}
+        scanner := bufio.NewScanner(f)
+        for scanner.Scan() {
+                // address perms offset dev inode pathname
+                fields := strings.Fields(scanner.Text())
+                if len(fields) < 6 || !strings.HasPrefix(fields[5], "/") {
+                        continue
+                }
+                files[strings.Join(fields[5:], " ")] = struct{}{}
+        }
+        return len(files), scanner.Err()
+}
+
+// threadSample is a thread's cumulative CPU time at a point in time.
+type threadSample struct {
+        seconds float64
+        at      time.Time
+}
+
+// threadCPUPrev holds the previous sample per TID so usage can be computed
+// over the interval between scrapes.
+var threadCPUPrev = map[int32]threadSample{}
+
+// collectThreadCPU reports CPU percent for each thread in /proc/<pid>/task.
+// A thread's first sample only primes threadCPUPrev.
+func collectThreadCPU(p sourceProcess, name string, now time.Time, live map[int32]bool) {
+        threads, err := p.Threads()
+        if err != nil {
+                return
+        }
+        pid := fmt.Sprint(p.pid())
+        stateMu.Lock()
+        defer stateMu.Unlock()
+        for tid, times := range threads {
+                live[tid] = true
+                cur := threadSample{seconds: times.User + times.System, at: now}
+                prev, ok := threadCPUPrev[tid]
+                threadCPUPrev[tid] = cur
+                if !ok {
+                        continue
+                }
+                elapsed := cur.at.Sub(prev.at).Seconds()
+                if elapsed <= 0 || cur.seconds < prev.seconds {
+                        continue
+                }
+                percent := (cur.seconds - prev.seconds) / elapsed * 100
+                threadCPUGauge.WithLabelValues(name, pid, fmt.Sprint(tid)).Set(percent)
+        }
+}
+
+// runCollector collects every interval so /metrics only serves the last
+// results. It returns once ctx is cancelled, after any running collection.
+func runCollector(ctx context.Context, interval time.Duration) {
+        ticker := time.NewTicker(interval)
+        defer ticker.Stop()
+        for {
+                collectMu.Lock()
+                collectMetrics()
+                collectMu.Unlock()
+                select {
+                case <-ctx.Done():
+                        return
+                case <-ticker.C:
+                }
+        }
+}
+
+// hostCPUBits holds the latest host CPU percent from runHostCPUSampler as
+// math.Float64bits; hostCPUSampled is set once it has a value.
+var (
+        hostCPUBits    atomic.Uint64
+        hostCPUSampled atomic.Bool
+)
+
+// runHostCPUSampler measures host CPU usage over fixed intervals so
+// server_available_cpu_cores doesn't depend on how far apart scrapes are.
+// It never returns.
+func runHostCPUSampler(interval time.Duration) {
+        for {
+                percents, err := cpu.Percent(interval, false)
+                if err != nil || len(percents) == 0 {
+                        time.Sleep(interval)
+                        continue
+                }
+                hostCPUBits.Store(math.Float64bits(percents[0]))
+                hostCPUSampled.Store(true)
+        }
+}
+
+// hostCPUPercent returns the sampler's latest reading, falling back to a
+// since-last-call measurement until the first interval has completed.
+func hostCPUPercent() (float64, bool) {
+        if hostCPUSampled.Load() {
+                return math.Float64frombits(hostCPUBits.Load()), true
+        }
+        percents, err := cpu.Percent(0, false)
+        if err != nil || len(percents) == 0 {
+                return 0, false
+        }
+        return percents[0], true
+}
+
+// prevCPUTimes is the aggregate CPU times from the previous scrape.
+var prevCPUTimes *cpu.TimesStat
+
+// collectCPUSteal sets the steal share of CPU time elapsed since the
+// previous scrape. The first scrape only records a baseline.
+func collectCPUSteal() {
+        times, err := cpu.Times(false)
+        if err != nil || len(times) == 0 {
+                return
+        }
+        cur := times[0]
+        prev := prevCPUTimes
+        prevCPUTimes = &cur
+        if prev == nil {
+                return
+        }
+        total := cpuTotalTime(cur) - cpuTotalTime(*prev)
+        if total <= 0 {
+                return
+        }
+        serverCPUStealPercent.Set((cur.Steal - prev.Steal) / total * 100)
+}
+
+// collectLoadAvg sets the load averages. Platforms without them (Windows)
+// leave the gauges at 0.
+func collectLoadAvg() {
+        avg, err := load.Avg()
+        if err != nil {
+                return
+        }
+        serverLoad1.Set(avg.Load1)
+        serverLoad5.Set(avg.Load5)
+        serverLoad15.Set(avg.Load15)
+}
+
+// collectPerCoreCPU sets each core's busy percent since the previous scrape.
+func collectPerCoreCPU() {
+        percents, err := cpu.Percent(0, true)
+        if err != nil {
+                return
+        }
+        for i, percent := range percents {
+                serverCPUCorePercent.WithLabelValues(strconv.Itoa(i)).Set(percent)
+        }
+}
+
+// cpuTotalTime sums all CPU time buckets. Guest time is already included in
+// user and nice on Linux, so it is not added again.
+func cpuTotalTime(t cpu.TimesStat) float64 {
+        return t.User + t.System + t.Idle + t.Nice + t.Iowait + t.Irq + t.Softirq + t.Steal
+}
+
+// collectDiskIO publishes the kernel's cumulative per-device byte counters.
+// The vectors are reset first so the counters carry the kernel's values
+// as-is and devices that went away drop out.
+func collectDiskIO() {
+        counters, err := disk.IOCounters()
+        if err != nil {
+                return
+        }
+        serverDiskReadBytes.Reset()
+        serverDiskWriteBytes.Reset()
+        for dev, c := range counters {
+                serverDiskReadBytes.WithLabelValues(dev).Add(float64(c.ReadBytes))
+                serverDiskWriteBytes.WithLabelValues(dev).Add(float64(c.WriteBytes))
+        }
+}
+
+// isWatched reports whether name is listed in watch_names.
+func isWatched(name string) bool {
+        return contains(config.WatchNames, name)
+}
+
+// metricsHandler serves the metrics of the latest completed collection.
+// With collect_on_scrape (onScrape) it collects first; otherwise it never
+// waits for the background collector.
+func metricsHandler(onScrape bool) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                if onScrape {
+                        collectMu.Lock()
+                        collectOnScrape()
+                        collectMu.Unlock()
+                }
+                exposed.Load().handler.ServeHTTP(w, r)
+        }
+}
+
+// collectOnScrape runs a collection for a request when collect_on_scrape
+// is set, unless the previous one finished less than min_scrape_interval
+// ago; then the request gets the previous results, so a scrape storm
+// can't turn into back-to-back process scans. Called with collectMu held.
+func collectOnScrape() {
+        if !config.CollectOnScrape {
+                return
+        }
+        if !lastCollectDone.IsZero() && time.Since(lastCollectDone) < config.MinScrapeInterval {
+                scrapesDebounced.Inc()
+                return
+        }
+        collectMetrics()
+}
+
+// snapshotHandler serves the processes matched by the latest collection as
+// JSON, collecting first with collect_on_scrape (onScrape). Unlike /metrics
+// it lists every matched process; top_n and max_series don't apply.
+func snapshotHandler(onScrape bool) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                if onScrape {
+                        collectMu.Lock()
+                        collectOnScrape()
+                        collectMu.Unlock()
+                }
+
+                w.Header().Set("Content-Type", "application/json")
+                samples := lastSamples.Load()
+                if samples == nil {
+                        w.WriteHeader(http.StatusServiceUnavailable)
+                        json.NewEncoder(w).Encode(map[string]string{"status": "no completed scrape yet"})
+                        return
+                }
+                json.NewEncoder(w).Encode(*samples)
+        }
+}
+
+// writeOneshot runs a single collection and writes the result to w in the
+// Prometheus text format, for checking a config without a scraper.
+func writeOneshot(w io.Writer) error {
+        collectMetrics()
+        mfs, err := exposed.Load().gatherer.Gather()
+        if err != nil {
+                return err
+        }
+        enc := expfmt.NewEncoder(w, expfmt.NewFormat(expfmt.TypeTextPlain))
+        for _, mf := range mfs {
+                if err := enc.Encode(mf); err != nil {
+                        return err
+                }
+        }
+        return nil
+}
+
+// healthzHandler reports whether a collection has completed, without
+// running one, so probes stay cheap.
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Content-Type", "application/json")
+        summary := lastScrape.Load()
+        if summary == nil {
+                w.WriteHeader(http.StatusServiceUnavailable)
+                json.NewEncoder(w).Encode(map[string]string{"status": "no completed scrape yet"})
+                return
+        }
+        json.NewEncoder(w).Encode(struct {
+                Status              string    `json:"status"`
+                ProcessesLastScrape int       `json:"processes_last_scrape"`
+                LastScrape          time.Time `json:"last_scrape"`
+        }{"ok", summary.processes, summary.at})
+}
+
+// sortedJoin returns the values sorted and comma-joined, so equal sets
+// produce equal label values regardless of config order.
+func sortedJoin(values []string) string {
+        sorted := append([]string(nil), values...)
+        sort.Strings(sorted)
+        return strings.Join(sorted, ",")
+}
+
+func contains(slice []string, val string) bool {
+        for _, v := range slice {
+                if v == val {
                         return true
                 }
         }
         return false
 }
 
+// checkListenAddress reports whether addr is a usable host:port.
+func checkListenAddress(addr string) error {
+        if path, ok := strings.CutPrefix(addr, unixSocketPrefix); ok {
+                if path == "" {
+                        return errors.New("empty socket path")
+                }
+                return nil
+        }
+        _, port, err := net.SplitHostPort(addr)
+        if err != nil {
+                return err
+        }
+        if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+                return fmt.Errorf("bad port %q", port)
+        }
+        return nil
+}
+
+// unixSocketPrefix marks a listen address that is a Unix socket path.
+const unixSocketPrefix = "unix:"
+
+// listen opens the listener for a listen address: host:port (IPv6 hosts
+// in brackets, e.g. [::1]:9001) or unix:<path>. A socket file left behind
+// by an unclean exit is replaced; any other file at path is an error. The
+// socket file is removed again when the listener is closed.
+func listen(addr string) (net.Listener, error) {
+        path, ok := strings.CutPrefix(addr, unixSocketPrefix)
+        if !ok {
+                return net.Listen("tcp", addr)
+        }
+        if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+                if err := os.Remove(path); err != nil {
+                        return nil, err
+                }
+        }
+        return net.Listen("unix", path)
+}
+
+// shutdownTimeout bounds how long in-flight requests get to finish after
+// SIGTERM or SIGINT.
+const shutdownTimeout = 10 * time.Second
+
+// cliFlags are the command-line settings that take precedence over the
+// config file, both at startup and on reload.
+type cliFlags struct {
+        quiet         bool
+        listenAddress string
+        includeTypes  []string
+}
+
+func (f cliFlags) apply(c *Config) {
+        if f.listenAddress != "" {
+                c.ListenAddress = f.listenAddress
+        }
+        if len(f.includeTypes) > 0 {
+                c.IncludeTypes = f.includeTypes
+        }
+}
+
 func main() {
-        configPath := flag.String("config", "config.yaml", "Path to the config file")
+        configPath := flag.String("config", "config.yaml", "Path to the config file, or - to read it from stdin; without it $"+envConfigVar+" is used if set")
+        quietFlag := flag.Bool("quiet", false, "Suppress info-level logging (same as log_level: error)")
+        oneshot := flag.Bool("oneshot", false, "Collect once, print the metrics to stdout in text format and exit")
+        listenAddress := flag.String("listen-address", "", "Address to listen on, overriding listen_address")
+        includeTypes := flag.String("include-types", "", "Comma-separated process types to collect, overriding include_types")
         flag.Parse()
 
-        loadConfig(*configPath)
+        // an explicit --config wins over the environment
+        configSet := false
+        flag.Visit(func(f *flag.Flag) {
+                if f.Name == "config" {
+                        configSet = true
+                }
+        })
+        if !configSet && os.Getenv(envConfigVar) != "" {
+                *configPath = envConfigPath
+        }
+
+        if *listenAddress != "" {
+                if err := checkListenAddress(*listenAddress); err != nil {
+                        fatal("invalid --listen-address", "address", *listenAddress, "err", err)
+                }
+        }
+        flags := cliFlags{quiet: *quietFlag, listenAddress: *listenAddress}
+        for _, t := range strings.Split(*includeTypes, ",") {
+                if t = strings.TrimSpace(t); t != "" {
+                        flags.includeTypes = append(flags.includeTypes, t)
+                }
+        }
+
+        var err error
+        config, err = loadConfig(*configPath)
+        if err != nil {
+                fatal("failed to load config", "err", err)
+        }
+        flags.apply(&config)
+        setupLogging(config, flags.quiet)
+        // gopsutil reads HOST_PROC on every call, so this covers the
+        // process list, per-process reads and the host metrics
+        os.Setenv("HOST_PROC", config.ProcPath)
+        procRoot = config.ProcPath
         initMetrics()
+        if *oneshot {
+                if err := writeOneshot(os.Stdout); err != nil {
+                        fatal("oneshot failed", "err", err)
+                }
+                return
+        }
+        // cancelled on SIGTERM or SIGINT; everything below winds down then
+        ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+        defer stop()
+        // background loops that must finish before the process exits
+        var wg sync.WaitGroup
+        background := func(run func(context.Context)) {
+                wg.Add(1)
+                go func() {
+                        defer wg.Done()
+                        run(ctx)
+                }()
+        }
+
+        go reloadOnSIGHUP(*configPath, flags)
+        go runHostCPUSampler(config.HostCPUSampleInterval)
+        if !config.CollectOnScrape {
+                background(func(ctx context.Context) { runCollector(ctx, config.ScrapeInterval) })
+        }
+
+        if config.RemoteWrite.URL != "" {
+                slog.Info("pushing metrics with remote write", "url", config.RemoteWrite.URL, "interval", config.RemoteWrite.Interval)
+                background(runRemoteWrite)
+        }
+        if config.Push.GatewayURL != "" {
+                slog.Info("pushing metrics to Pushgateway", "url", config.Push.GatewayURL, "interval", config.Push.Interval)
+                background(runPush)
+        }
+
+        var server *http.Server
+        if !config.DisableHTTP {
+                http.Handle(config.MetricsPath, requireBasicAuth(metricsHandler(config.CollectOnScrape)))
+                http.Handle("/snapshot", requireBasicAuth(snapshotHandler(config.CollectOnScrape)))
+                if config.DebugClassify {
+                        http.Handle("/debug/classify", requireBasicAuth(http.HandlerFunc(classifyHandler)))
+                }
+                if config.EnableReloadEndpoint {
+                        http.Handle("/-/reload", requireBasicAuth(reloadHandler(*configPath, flags)))
+                }
+                http.HandleFunc("/healthz", healthzHandler)
+                server = &http.Server{Addr: config.ListenAddress}
+                if config.TLS.CertFile != "" {
+                        reloader, err := newCertReloader(config.TLS.CertFile, config.TLS.KeyFile)
+                        if err != nil {
+                                fatal("failed to load TLS certificate", "err", err)
+                        }
+                        server.TLSConfig = &tls.Config{GetCertificate: reloader.GetCertificate}
+                }
+                ln, err := listen(config.ListenAddress)
+                if err != nil {
+                        fatal("failed to listen", "address", config.ListenAddress, "err", err)
+                }
+                slog.Info("exporter running", "address", config.ListenAddress, "path", config.MetricsPath)
+                go func() {
+                        // Shutdown closes ln, which also removes a Unix socket file
+                        var err error
+                        if server.TLSConfig != nil {
+                                err = server.ServeTLS(ln, "", "")
+                        } else {
+                                err = server.Serve(ln)
+                        }
+                        if !errors.Is(err, http.ErrServerClosed) {
+                                fatal("server stopped", "err", err)
+                        }
+                }()
+        }
 
-        http.Handle("/metrics", http.HandlerFunc(metricsHandler))
-        log.Printf("Exporter running on %s/metrics\n", config.ListenAddress)
-        log.Fatal(http.ListenAndServe(config.ListenAddress, nil))
+        <-ctx.Done()
+        // a second signal kills the process without waiting
+        stop()
+        slog.Info("shutting down")
+        if server != nil {
+                shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+                defer cancel()
+                if err := server.Shutdown(shutdownCtx); err != nil {
+                        slog.Error("HTTP server shutdown", "err", err)
+                }
+        }
+        wg.Wait()
 }
@@ -0,0 +1,804 @@
+package main
+
+import (
+        "errors"
+        "fmt"
+        "io/fs"
+        "net"
+        "net/http/httptest"
+        "os"
+        "path/filepath"
+        "regexp"
+        "runtime"
+        "strings"
+        "testing"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+        "github.com/shirou/gopsutil/v4/cpu"
+        "github.com/shirou/gopsutil/v4/process"
+)
+
+func TestCgroupContainerType(t *testing.T) {
+        tests := []struct {
+                name   string
+                cgroup string
+                want   string
+        }{
+                {
+                        name: "v1 host process",
+                        cgroup: "12:pids:/user.slice/user-1000.slice/session-2.scope\n" +
+                                "4:memory:/user.slice/user-1000.slice/session-2.scope\n" +
+                                "1:name=systemd:/user.slice/user-1000.slice/session-2.scope\n",
+                        want: "",
+                },
+                {
+                        name: "v1 docker cgroupfs driver",
+                        cgroup: "12:pids:/docker/3f2a9c1d8e7b\n" +
+                                "4:memory:/docker/3f2a9c1d8e7b\n" +
+                                "1:name=systemd:/docker/3f2a9c1d8e7b\n",
+                        want: "docker_app",
+                },
+                {
+                        name: "v1 docker systemd driver",
+                        cgroup: "4:memory:/system.slice/docker-3f2a9c1d8e7b.scope\n" +
+                                "1:name=systemd:/system.slice/docker-3f2a9c1d8e7b.scope\n",
+                        want: "docker_app",
+                },
+                {
+                        name: "v1 kubernetes pod",
+                        cgroup: "4:memory:/kubepods/burstable/pod1b2c3d4e/3f2a9c1d8e7b\n" +
+                                "1:name=systemd:/kubepods/burstable/pod1b2c3d4e/3f2a9c1d8e7b\n",
+                        want: "kubernetes",
+                },
+                {
+                        name:   "v2 host service",
+                        cgroup: "0::/system.slice/sshd.service\n",
+                        want:   "",
+                },
+                {
+                        name:   "v2 login session scope",
+                        cgroup: "0::/user.slice/user-1000.slice/session-2.scope\n",
+                        want:   "",
+                },
+                {
+                        name:   "v2 dockerd itself",
+                        cgroup: "0::/system.slice/docker.service\n",
+                        want:   "",
+                },
+                {
+                        name:   "v2 docker systemd driver",
+                        cgroup: "0::/system.slice/docker-3f2a9c1d8e7b.scope\n",
+                        want:   "docker_app",
+                },
+                {
+                        name:   "v2 docker cgroupfs driver",
+                        cgroup: "0::/docker/3f2a9c1d8e7b\n",
+                        want:   "docker_app",
+                },
+                {
+                        name:   "v2 kubernetes pod with containerd",
+                        cgroup: "0::/kubepods.slice/kubepods-burstable.slice/kubepods-burstable-pod1b2c3d4e.slice/cri-containerd-3f2a9c1d8e7b.scope\n",
+                        want:   "kubernetes",
+                },
+                {
+                        name:   "v2 containerd outside kubernetes",
+                        cgroup: "0::/system.slice/cri-containerd-3f2a9c1d8e7b.scope\n",
+                        want:   "docker_app",
+                },
+                {
+                        name:   "unreadable",
+                        cgroup: "",
+                        want:   "",
+                },
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        if got := cgroupContainerType(tt.cgroup); got != tt.want {
+                                t.Errorf("cgroupContainerType(%q) = %q, want %q", tt.cgroup, got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestSystemdUnit(t *testing.T) {
+        tests := []struct {
+                name   string
+                cgroup string
+                want   string
+        }{
+                {
+                        name:   "v2 service",
+                        cgroup: "0::/system.slice/nginx.service\n",
+                        want:   "nginx",
+                },
+                {
+                        name: "v1 service",
+                        cgroup: "4:memory:/system.slice/nginx.service\n" +
+                                "1:name=systemd:/system.slice/nginx.service\n",
+                        want: "nginx",
+                },
+                {
+                        name:   "template instance",
+                        cgroup: "0::/system.slice/system-getty.slice/getty@tty1.service\n",
+                        want:   "getty@tty1",
+                },
+                {
+                        name:   "delegated subtree",
+                        cgroup: "0::/system.slice/postgresql.service/payload\n",
+                        want:   "postgresql",
+                },
+                {
+                        name:   "docker container scope",
+                        cgroup: "0::/system.slice/docker-3f2a9c1d8e7b.scope\n",
+                        want:   "",
+                },
+                {
+                        name:   "user unit",
+                        cgroup: "0::/user.slice/user-1000.slice/user@1000.service/app.slice/syncthing.service\n",
+                        want:   "",
+                },
+                {
+                        name:   "unreadable",
+                        cgroup: "",
+                        want:   "",
+                },
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        if got := systemdUnit(tt.cgroup); got != tt.want {
+                                t.Errorf("systemdUnit(%q) = %q, want %q", tt.cgroup, got, tt.want)
+                        }
+                })
+        }
+}
+
+// BenchmarkProcessIdentity compares classifying every running process from
+// /proc on each scrape with reusing the identity cache.
+func BenchmarkProcessIdentity(b *testing.B) {
+        procs, err := listProcesses()
+        if err != nil {
+                b.Fatal(err)
+        }
+        b.Run("uncached", func(b *testing.B) {
+                for i := 0; i < b.N; i++ {
+                        for _, p := range procs {
+                                info, err := readSourceCgroup(p)
+                                if err != nil {
+                                        continue
+                                }
+                                ptype := getProcessType(info)
+                                getProcessName(info, ptype)
+                                getWorkingDirectory(p)
+                        }
+                }
+        })
+        b.Run("cached", func(b *testing.B) {
+                identityCache = map[int32]identity{}
+                for _, p := range procs {
+                        processIdentity(p)
+                }
+                b.ResetTimer()
+                for i := 0; i < b.N; i++ {
+                        for _, p := range procs {
+                                processIdentity(p)
+                        }
+                }
+        })
+}
+
+// BenchmarkSampleProcesses compares sampling every running process one by
+// one with the default collection_workers.
+func BenchmarkSampleProcesses(b *testing.B) {
+        var err error
+        config, err = loadConfig("config.yaml")
+        if err != nil {
+                b.Fatal(err)
+        }
+        initMetrics()
+        procs, err := listProcesses()
+        if err != nil {
+                b.Fatal(err)
+        }
+        for _, workers := range []int{1, runtime.NumCPU()} {
+                b.Run(fmt.Sprintf("workers=%d", workers), func(b *testing.B) {
+                        config.CollectionWorkers = workers
+                        for i := 0; i < b.N; i++ {
+                                st := &scrapeState{
+                                        now:         time.Now(),
+                                        running:     map[string]bool{},
+                                        livePids:    map[int32]bool{},
+                                        liveThreads: map[int32]bool{},
+                                        seen:        map[string][]string{},
+                                }
+                                sampleProcesses(procs, st)
+                        }
+                })
+        }
+}
+
+// fakeProcess is a processInfo with fixed values.
+type fakeProcess struct {
+        name       string
+        cmdline    []string
+        cmdlineErr error
+        cgroupData string
+}
+
+func (p fakeProcess) Name() (string, error)           { return p.name, nil }
+func (p fakeProcess) Cmdline() (string, error)        { return strings.Join(p.cmdline, " "), p.cmdlineErr }
+func (p fakeProcess) CmdlineSlice() ([]string, error) { return p.cmdline, p.cmdlineErr }
+func (p fakeProcess) CreateTime() (int64, error)      { return 0, nil }
+func (p fakeProcess) pid() int32                      { return 4242 }
+func (p fakeProcess) cgroup() string                  { return p.cgroupData }
+
+// fakeSourceProcess is a listed process with fixed values, so collection
+// can run without /proc.
+type fakeSourceProcess struct {
+        fakeProcess
+        id         int32
+        ppid       int32
+        user       string
+        rssMB      uint64
+        cpuPercent float64
+        // MemoryInfo's error, as for a process that exited after listing
+        memErr error
+}
+
+func (p fakeSourceProcess) pid() int32                   { return p.id }
+func (p fakeSourceProcess) Username() (string, error)    { return p.user, nil }
+func (p fakeSourceProcess) Ppid() (int32, error)         { return p.ppid, nil }
+func (p fakeSourceProcess) Tgid() (int32, error)         { return p.id, nil }
+func (p fakeSourceProcess) Exe() (string, error)         { return "", errors.ErrUnsupported }
+func (p fakeSourceProcess) Cwd() (string, error)         { return "", errors.ErrUnsupported }
+func (p fakeSourceProcess) Terminal() (string, error)    { return "", nil }
+func (p fakeSourceProcess) Environ() ([]string, error)   { return nil, nil }
+func (p fakeSourceProcess) CPUPercent() (float64, error) { return p.cpuPercent, nil }
+func (p fakeSourceProcess) readCgroup() (string, error)  { return p.cgroupData, nil }
+
+func (p fakeSourceProcess) Times() (*cpu.TimesStat, error) { return &cpu.TimesStat{}, nil }
+
+func (p fakeSourceProcess) MemoryInfo() (*process.MemoryInfoStat, error) {
+        if p.memErr != nil {
+                return nil, p.memErr
+        }
+        return &process.MemoryInfoStat{RSS: p.rssMB * 1024 * 1024}, nil
+}
+
+func (p fakeSourceProcess) MemoryInfoEx() (*process.MemoryInfoExStat, error) {
+        return nil, errors.ErrUnsupported
+}
+func (p fakeSourceProcess) NumFDs() (int32, error)     { return 0, errors.ErrUnsupported }
+func (p fakeSourceProcess) NumThreads() (int32, error) { return 1, nil }
+func (p fakeSourceProcess) NumCtxSwitches() (*process.NumCtxSwitchesStat, error) {
+        return nil, errors.ErrUnsupported
+}
+func (p fakeSourceProcess) PageFaults() (*process.PageFaultsStat, error) {
+        return nil, errors.ErrUnsupported
+}
+func (p fakeSourceProcess) Rlimit() ([]process.RlimitStat, error) { return nil, errors.ErrUnsupported }
+func (p fakeSourceProcess) Threads() (map[int32]*cpu.TimesStat, error) {
+        return nil, errors.ErrUnsupported
+}
+
+// withSource makes procs the running processes for the rest of the test.
+func withSource(t *testing.T, procs ...fakeSourceProcess) {
+        t.Helper()
+        savedList, savedLookup := listProcesses, lookupProcess
+        listProcesses = func() ([]sourceProcess, error) {
+                listed := make([]sourceProcess, len(procs))
+                for i, p := range procs {
+                        listed[i] = p
+                }
+                return listed, nil
+        }
+        lookupProcess = func(pid int32) (sourceProcess, error) {
+                for _, p := range procs {
+                        if p.id == pid {
+                                return p, nil
+                        }
+                }
+                return nil, fs.ErrNotExist
+        }
+        t.Cleanup(func() { listProcesses, lookupProcess = savedList, savedLookup })
+}
+
+// withConfig swaps in c as the running config for the rest of the test.
+func withConfig(t *testing.T, c Config) {
+        t.Helper()
+        saved := config
+        config = c
+        t.Cleanup(func() { config = saved })
+}
+
+func TestGetProcessType(t *testing.T) {
+        withConfig(t, Config{
+                TypeRules: []TypeRule{
+                        {Pattern: "^gunicorn", Type: "python_web", re: regexp.MustCompile("^gunicorn")},
+                        {Pattern: "clickhouse-server", Type: "database", Cmdline: true, re: regexp.MustCompile("clickhouse-server")},
+                },
+        })
+        tests := []struct {
+                name string
+                p    fakeProcess
+                want string
+        }{
+                {"java", fakeProcess{name: "java"}, "java"},
+                {"versioned python", fakeProcess{name: "python3.11"}, "python"},
+                {"node", fakeProcess{name: "node"}, "node"},
+                {"dockerd", fakeProcess{name: "dockerd"}, "docker"},
+                {"containerd", fakeProcess{name: "containerd"}, "docker"},
+                {"case insensitive", fakeProcess{name: "Java"}, "java"},
+                {"in a container", fakeProcess{name: "nginx", cgroupData: "0::/system.slice/docker-3f2a9c1d8e7b.scope\n"}, "docker_app"},
+                {"in a pod", fakeProcess{name: "nginx", cgroupData: "0::/kubepods/burstable/pod1b2c3d4e/3f2a9c1d8e7b\n"}, "kubernetes"},
+                {"systemd service", fakeProcess{name: "nginx", cgroupData: "0::/system.slice/nginx.service\n"}, "systemd"},
+                {"login session", fakeProcess{name: "bash", cgroupData: "0::/user.slice/user-1000.slice/session-2.scope\n"}, "system"},
+                {"no cgroup", fakeProcess{name: "bash"}, "system"},
+                {"type rule on name", fakeProcess{name: "gunicorn"}, "python_web"},
+                {"type rule on cmdline", fakeProcess{name: "server", cmdline: []string{"/usr/bin/clickhouse-server", "--daemon"}}, "database"},
+                {"type rule wins over built-in", fakeProcess{name: "gunicorn-java"}, "python_web"},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        if got := getProcessType(tt.p); got != tt.want {
+                                t.Errorf("getProcessType(%+v) = %q, want %q", tt.p, got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestGetProcessName(t *testing.T) {
+        tests := []struct {
+                name        string
+                nameMaxArgs int
+                nameRules   []NameRule
+                ptype       string
+                p           fakeProcess
+                want        string
+        }{
+                {
+                        name: "system id prefix",
+                        p:    fakeProcess{name: "java", cmdline: []string{"java", "-Xmx1g", "-D.system.id=billing", "-jar", "app.jar"}},
+                        want: "billing",
+                },
+                {
+                        name: "flag with separate value",
+                        p:    fakeProcess{name: "python3", cmdline: []string{"python3", "app.py", "--service-name", "reports"}},
+                        want: "reports",
+                },
+                {
+                        name: "empty system id falls back to executable",
+                        p:    fakeProcess{name: "java", cmdline: []string{"java", "-D.system.id=", "-jar", "app.jar"}},
+                        want: "java",
+                },
+                {
+                        name: "trailing flag without value",
+                        p:    fakeProcess{name: "python3", cmdline: []string{"python3", "app.py", "--service-name"}},
+                        want: "python3",
+                },
+                {
+                        name: "no naming flag",
+                        p:    fakeProcess{name: "java", cmdline: []string{"java", "-jar", "app.jar"}},
+                        want: "java",
+                },
+                {
+                        name: "unreadable command line",
+                        p:    fakeProcess{name: "java", cmdlineErr: errors.New("permission denied")},
+                        want: unreadableName,
+                },
+                {
+                        name:        "flag beyond name_max_args",
+                        nameMaxArgs: 2,
+                        p:           fakeProcess{name: "java", cmdline: []string{"java", "-Xmx1g", "-D.system.id=billing"}},
+                        want:        "java",
+                },
+                {
+                        name:  "systemd unit",
+                        ptype: "systemd",
+                        p:     fakeProcess{name: "nginx", cmdline: []string{"nginx", "-g", "daemon off;"}, cgroupData: "0::/system.slice/nginx.service\n"},
+                        want:  "nginx",
+                },
+                {
+                        name:      "name rule wins over flags",
+                        nameRules: []NameRule{{Match: `-Dservice\.name=([^ ]+)`, re: regexp.MustCompile(`-Dservice\.name=([^ ]+)`)}},
+                        p:         fakeProcess{name: "java", cmdline: []string{"java", "-Dservice.name=orders", "-D.system.id=billing"}},
+                        want:      "orders",
+                },
+                {
+                        name:      "name rule for another type",
+                        nameRules: []NameRule{{Match: `-Dservice\.name=([^ ]+)`, Type: "python", re: regexp.MustCompile(`-Dservice\.name=([^ ]+)`)}},
+                        ptype:     "java",
+                        p:         fakeProcess{name: "java", cmdline: []string{"java", "-Dservice.name=orders", "-D.system.id=billing"}},
+                        want:      "billing",
+                },
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, Config{
+                                NameFromArgs: []string{"-D.system.id=", "--service-name"},
+                                NameMaxArgs:  tt.nameMaxArgs,
+                                NameRules:    tt.nameRules,
+                        })
+                        if got := getProcessName(tt.p, tt.ptype); got != tt.want {
+                                t.Errorf("getProcessName(%+v, %q) = %q, want %q", tt.p, tt.ptype, got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestJVMHeapFlag(t *testing.T) {
+        tests := []struct {
+                name   string
+                args   []string
+                flag   string
+                want   float64
+                wantOK bool
+        }{
+                {"gigabytes", []string{"java", "-Xmx2g", "-jar", "app.jar"}, "-Xmx", 2048, true},
+                {"megabytes upper case", []string{"java", "-Xms512M", "Main"}, "-Xms", 512, true},
+                {"kilobytes", []string{"java", "-Xmx1048576k"}, "-Xmx", 1024, true},
+                {"bytes", []string{"java", "-Xmx268435456"}, "-Xmx", 256, true},
+                {"last one wins", []string{"java", "-Xmx1g", "-Xmx4g"}, "-Xmx", 4096, true},
+                {"application argument after -jar", []string{"java", "-jar", "app.jar", "-Xmx8g"}, "-Xmx", 0, false},
+                {"not given", []string{"java", "-Xss1m", "-jar", "app.jar"}, "-Xmx", 0, false},
+                {"invalid size", []string{"java", "-Xmx2q"}, "-Xmx", 0, false},
+                {"empty size", []string{"java", "-Xmx"}, "-Xmx", 0, false},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        got, ok := jvmHeapFlag(tt.args, tt.flag)
+                        if got != tt.want || ok != tt.wantOK {
+                                t.Errorf("jvmHeapFlag(%q, %q) = %v, %v, want %v, %v", tt.args, tt.flag, got, ok, tt.want, tt.wantOK)
+                        }
+                })
+        }
+}
+
+// fakeProcRoot creates a proc_path with one process, pid 42, and points the
+// config at it.
+func fakeProcRoot(t *testing.T) string {
+        t.Helper()
+        root := t.TempDir()
+        dir := filepath.Join(root, "42")
+        if err := os.Mkdir(dir, 0o755); err != nil {
+                t.Fatal(err)
+        }
+        if err := os.WriteFile(filepath.Join(dir, "cgroup"), []byte("0::/system.slice/nginx.service\n"), 0o644); err != nil {
+                t.Fatal(err)
+        }
+        if err := os.Symlink("/srv/nginx", filepath.Join(dir, "cwd")); err != nil {
+                t.Fatal(err)
+        }
+        withProcRoot(t, root)
+        return root
+}
+
+// withProcRoot points procFile at root for the rest of the test.
+func withProcRoot(t *testing.T, root string) {
+        t.Helper()
+        saved := procRoot
+        procRoot = root
+        t.Cleanup(func() { procRoot = saved })
+}
+
+func TestProcFile(t *testing.T) {
+        withProcRoot(t, "/host/proc")
+        if got, want := procFile(42, "cgroup"), "/host/proc/42/cgroup"; got != want {
+                t.Errorf("procFile(42, cgroup) = %q, want %q", got, want)
+        }
+        withProcRoot(t, "/host/proc/")
+        if got, want := procFile(7, "cwd"), "/host/proc/7/cwd"; got != want {
+                t.Errorf("procFile(7, cwd) = %q, want %q", got, want)
+        }
+}
+
+func TestProcPathReads(t *testing.T) {
+        if !hasProcfs {
+                t.Skip("no procfs on " + runtime.GOOS)
+        }
+        fakeProcRoot(t)
+
+        cgroup, err := readCgroup(42)
+        if err != nil || cgroup != "0::/system.slice/nginx.service\n" {
+                t.Errorf("readCgroup(42) = %q, %v, want the file under proc_path", cgroup, err)
+        }
+        if got := getWorkingDirectory(procfsProcess{&process.Process{Pid: 42}}); got != "/srv/nginx" {
+                t.Errorf("getWorkingDirectory(42) = %q, want /srv/nginx", got)
+        }
+}
+
+func TestExitedProcess(t *testing.T) {
+        if !hasProcfs {
+                t.Skip("no procfs on " + runtime.GOOS)
+        }
+        fakeProcRoot(t)
+
+        // pid 43 isn't in proc_path: it exited after being listed
+        if _, err := readCgroup(43); !processGone(err) {
+                t.Errorf("readCgroup(43) error = %v, want processGone", err)
+        }
+        if _, err := processIdentity(procfsProcess{&process.Process{Pid: 43}}); !processGone(err) {
+                t.Errorf("processIdentity(43) error = %v, want processGone", err)
+        }
+        if _, ok := identityCache[43]; ok {
+                t.Error("exited process was cached")
+        }
+}
+
+func TestCmdlineLabel(t *testing.T) {
+        redact := []*regexp.Regexp{regexp.MustCompile(`(?i)password|token`), regexp.MustCompile(`^sk-`)}
+        tests := []struct {
+                name   string
+                maxLen int
+                args   []string
+                want   string
+        }{
+                {"plain", 256, []string{"java", "-jar", "app.jar"}, "java -jar app.jar"},
+                {"flag value redacted", 256, []string{"app", "--db-password=hunter2", "--port=80"}, "app --db-password=<redacted> --port=80"},
+                {"separate flag value redacted", 256, []string{"app", "--password", "hunter2", "--port", "80"}, "app --password <redacted> --port 80"},
+                {"flag without a value", 256, []string{"app", "--token"}, "app --token"},
+                {"bare arg redacted", 256, []string{"app", "sk-abc123", "serve"}, "app <redacted> serve"},
+                {"truncated", 8, []string{"java", "-jar", "app.jar"}, "java -ja"},
+                {"not cut inside a character", 8, []string{"run", "café"}, "run caf"},
+                {"unreadable", 256, nil, ""},
+        }
+        for _, tt := range tests {
+                t.Run(tt.name, func(t *testing.T) {
+                        withConfig(t, Config{CmdlineMaxLength: tt.maxLen, redactArgs: redact})
+                        if got := cmdlineLabel(tt.args); got != tt.want {
+                                t.Errorf("cmdlineLabel(%q) = %q, want %q", tt.args, got, tt.want)
+                        }
+                })
+        }
+}
+
+func TestClassifySnapshot(t *testing.T) {
+        withConfig(t, Config{
+                IncludeTypes: []string{"all"},
+                Classifier:   config.Classifier,
+                redactArgs:   []*regexp.Regexp{regexp.MustCompile(`(?i)password`)},
+        })
+        config.Classifier.Command = "/nonexistent/classify-process"
+        s := &procSnapshot{id: 4242, name: "java", cmdline: []string{"java", "--password", "hunter2", "-jar", "app.jar"}}
+
+        c := classify(s, &scrapeState{})
+        if c.Cmdline != "java --password <redacted> -jar app.jar" {
+                t.Errorf("cmdline = %q, want the value after --password redacted", c.Cmdline)
+        }
+        // the dry run falls back to the built-in type rather than running
+        // the classifier or caching its result
+        if c.DetectedType != "java" || c.MatchedRule != "built-in (not yet run through the classifier)" {
+                t.Errorf("type = %q from %q, want java from the built-in rules", c.DetectedType, c.MatchedRule)
+        }
+        if _, ok := cachedProcessType(s); ok {
+                t.Error("classify cached a classifier result")
+        }
+        if !c.Included {
+                t.Errorf("excluded by %q, want included", c.ExcludeReason)
+        }
+}
+
+func TestCheckListenAddress(t *testing.T) {
+        for _, addr := range []string{":9001", "0.0.0.0:9001", "[::1]:9001", "[::]:9001", "unix:/run/process_scout.sock"} {
+                if err := checkListenAddress(addr); err != nil {
+                        t.Errorf("checkListenAddress(%q) = %v, want nil", addr, err)
+                }
+        }
+        for _, addr := range []string{"9001", "::1:9001", "localhost:http-alt", ":70000", "unix:"} {
+                if err := checkListenAddress(addr); err == nil {
+                        t.Errorf("checkListenAddress(%q) = nil, want an error", addr)
+                }
+        }
+}
+
+func TestListenUnixSocket(t *testing.T) {
+        path := filepath.Join(t.TempDir(), "scout.sock")
+        // a socket left behind by a previous run
+        stale, err := listen(unixSocketPrefix + path)
+        if err != nil {
+                t.Skipf("unix sockets unavailable: %v", err)
+        }
+        stale.(*net.UnixListener).SetUnlinkOnClose(false)
+        stale.Close()
+
+        ln, err := listen(unixSocketPrefix + path)
+        if err != nil {
+                t.Fatalf("listen over a stale socket: %v", err)
+        }
+        ln.Close()
+        if _, err := os.Lstat(path); !os.IsNotExist(err) {
+                t.Errorf("socket file still present after Close: %v", err)
+        }
+
+        if err := os.WriteFile(path, nil, 0o644); err != nil {
+                t.Fatal(err)
+        }
+        if ln, err := listen(unixSocketPrefix + path); err == nil {
+                ln.Close()
+                t.Error("listen replaced a regular file")
+        }
+}
+
+func TestWriteRequestMarshal(t *testing.T) {
+        req := &WriteRequest{Timeseries: []TimeSeries{{
+                Labels:  []Label{{Name: "__name__", Value: "up"}},
+                Samples: []Sample{{Value: 1, Timestamp: 1000}},
+        }}}
+        got, err := req.Marshal()
+        if err != nil {
+                t.Fatal(err)
+        }
+        // as encoded by prompb.WriteRequest.Marshal
+        want := "\x0a\x1e" +
+                "\x0a\x0e\x0a\x08__name__\x12\x02up" +
+                "\x12\x0c\x09\x00\x00\x00\x00\x00\x00\xf0\x3f\x10\xe8\x07"
+        if string(got) != want {
+                t.Errorf("Marshal() = %x, want %x", got, want)
+        }
+}
+
+func TestTopSamples(t *testing.T) {
+        withConfig(t, Config{TopN: 2, TopBy: "memory"})
+        samples := []*ProcessSample{
+                {Pid: 1, MemoryMB: 10},
+                {Pid: 2, MemoryMB: 300},
+                {Pid: 3, MemoryMB: 200},
+        }
+        top := topSamples(samples)
+        if len(top) != 2 || top[0].Pid != 2 || top[1].Pid != 3 {
+                t.Errorf("topSamples() pids = %v, want [2 3]", samplePids(top))
+        }
+        // the full list is served on /snapshot in collection order
+        if got := samplePids(samples); fmt.Sprint(got) != "[1 2 3]" {
+                t.Errorf("samples reordered to %v, want [1 2 3]", got)
+        }
+}
+
+func samplePids(samples []*ProcessSample) []int32 {
+        pids := make([]int32, len(samples))
+        for i, s := range samples {
+                pids[i] = s.Pid
+        }
+        return pids
+}
+
+func TestCollectionInProgressDuringCollection(t *testing.T) {
+        live := prometheus.NewRegistry()
+        live.MustRegister(collectionInProgress)
+        saved := exposed.Load()
+        exposed.Store(newExposition(live))
+        t.Cleanup(func() { exposed.Store(saved) })
+
+        // a collection stuck reading /proc holds collectMu while it runs
+        collectMu.Lock()
+        defer collectMu.Unlock()
+        collectionStart.Store(time.Now().Add(-time.Minute).UnixNano())
+        defer collectionStart.Store(0)
+
+        done := make(chan int, 1)
+        go func() {
+                rec := httptest.NewRecorder()
+                metricsHandler(false)(rec, httptest.NewRequest("GET", "/metrics", nil))
+                done <- rec.Code
+        }()
+        select {
+        case code := <-done:
+                if code != 200 {
+                        t.Errorf("/metrics status = %d, want 200", code)
+                }
+        case <-time.After(5 * time.Second):
+                t.Fatal("/metrics waited for the running collection")
+        }
+
+        mfs, err := exposed.Load().gatherer.Gather()
+        if err != nil {
+                t.Fatal(err)
+        }
+        var got float64
+        for _, mf := range mfs {
+                if mf.GetName() == "process_scout_collection_in_progress_seconds" && len(mf.GetMetric()) == 1 {
+                        got = mf.GetMetric()[0].GetGauge().GetValue()
+                }
+        }
+        if got < 60 {
+                t.Errorf("process_scout_collection_in_progress_seconds = %v, want at least 60", got)
+        }
+}
+
+func TestScrapeDuringCollectionServesPreviousResults(t *testing.T) {
+        savedRegistry, savedGathered, savedExposed := registry, lastGathered.Load(), exposed.Load()
+        t.Cleanup(func() {
+                registry = savedRegistry
+                lastGathered.Store(savedGathered)
+                exposed.Store(savedExposed)
+        })
+        gauge := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "process_memory_mb"}, []string{"process_name"})
+        registry = prometheus.NewRegistry()
+        registry.MustRegister(gauge)
+        exposed.Store(newExposition(prometheus.NewRegistry()))
+
+        gauge.WithLabelValues("billing").Set(512)
+        publishCollected()
+
+        // the next collection has reset the vectors and not yet rewritten them
+        collectMu.Lock()
+        defer collectMu.Unlock()
+        gauge.Reset()
+
+        mfs, err := exposed.Load().gatherer.Gather()
+        if err != nil {
+                t.Fatal(err)
+        }
+        if len(mfs) != 1 || len(mfs[0].GetMetric()) != 1 || mfs[0].GetMetric()[0].GetGauge().GetValue() != 512 {
+                t.Errorf("gathered %v during a collection, want the previous process_memory_mb 512", mfs)
+        }
+}
+
+func TestLoadConfigPushWithSampleTimestamps(t *testing.T) {
+        path := filepath.Join(t.TempDir(), "config.yaml")
+        data := "sample_timestamps: true\npush:\n  gateway_url: http://pushgateway:9091\n"
+        if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+                t.Fatal(err)
+        }
+        if _, err := loadConfig(path); err == nil || !strings.Contains(err.Error(), "sample_timestamps") {
+                t.Errorf("loadConfig() error = %v, want sample_timestamps rejected with push", err)
+        }
+}
+
+func TestCollectMetricsFromSource(t *testing.T) {
+        path := filepath.Join(t.TempDir(), "config.yaml")
+        data := "include_types: [java]\nlabels:\n  process_name: true\n  type: true\n  user: true\n  parent_name: true\n"
+        if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+                t.Fatal(err)
+        }
+        c, err := loadConfig(path)
+        if err != nil {
+                t.Fatal(err)
+        }
+        withConfig(t, c)
+        withProcRoot(t, t.TempDir())
+        withSource(t,
+                fakeSourceProcess{fakeProcess: fakeProcess{name: "bash", cmdline: []string{"/bin/bash"}}, id: 9000, ppid: 1, user: "root", rssMB: 4},
+                fakeSourceProcess{fakeProcess: fakeProcess{name: "java", cmdline: []string{"java", "-Xmx2g", "-jar", "/srv/billing/billing.jar"}}, id: 9001, ppid: 9000, user: "app", rssMB: 512, cpuPercent: 12.5},
+                fakeSourceProcess{fakeProcess: fakeProcess{name: "python3", cmdline: []string{"python3", "worker.py"}}, id: 9002, ppid: 9000, user: "app", rssMB: 64},
+                // exited after being listed
+                fakeSourceProcess{fakeProcess: fakeProcess{name: "java", cmdline: []string{"java", "-jar", "/srv/gone.jar"}}, id: 9003, ppid: 9000, user: "app", memErr: fs.ErrNotExist},
+        )
+        savedRegistry, savedLive, savedGathered, savedExposed := registry, liveRegistry, lastGathered.Load(), exposed.Load()
+        t.Cleanup(func() {
+                registry, liveRegistry = savedRegistry, savedLive
+                lastGathered.Store(savedGathered)
+                exposed.Store(savedExposed)
+        })
+        initMetrics()
+
+        collectMetrics()
+
+        series := map[string]map[string]float64{}
+        for _, mf := range lastGathered.Load().mfs {
+                for _, m := range mf.GetMetric() {
+                        labels := []string{}
+                        for _, l := range m.GetLabel() {
+                                labels = append(labels, l.GetName()+"="+l.GetValue())
+                        }
+                        value := m.GetGauge().GetValue() + m.GetCounter().GetValue()
+                        if series[mf.GetName()] == nil {
+                                series[mf.GetName()] = map[string]float64{}
+                        }
+                        series[mf.GetName()][strings.Join(labels, ",")] = value
+                }
+        }
+        const java = "parent_name=bash,process_name=java,type=java,user=app"
+        if got := series["process_memory_mb"]; len(got) != 1 || got[java] != 512 {
+                t.Errorf("process_memory_mb = %v, want only {%s} 512", got, java)
+        }
+        if got := series["process_cpu_percent"][java]; got != 12.5 {
+                t.Errorf("process_cpu_percent{%s} = %v, want 12.5", java, got)
+        }
+        if got := series["process_scout_filtered_total"]["filter=include_types"]; got != 2 {
+                t.Errorf("process_scout_filtered_total{filter=include_types} = %v, want 2 (bash and python3)", got)
+        }
+        if got := series["processscout_collection_errors_total"]["operation=memory_info"]; got != 0 {
+                t.Errorf("processscout_collection_errors_total{operation=memory_info} = %v, want 0 for the exited process", got)
+        }
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+        "context"
+        "fmt"
+        "log/slog"
+        "net/http"
+        "time"
+
+        "github.com/prometheus/client_golang/prometheus"
+        "github.com/prometheus/client_golang/prometheus/push"
+        dto "github.com/prometheus/client_model/go"
+)
+
+// runPush pushes the latest samples to the configured Pushgateway on a
+// fixed interval. Once ctx is cancelled (on SIGTERM or SIGINT) it deletes
+// the pushed group, so a host that has gone away doesn't linger with its
+// last values, and returns.
+func runPush(ctx context.Context) {
+        // push only applies at startup; copy it rather than read config,
+        // which reloads swap under collectMu
+        collectMu.Lock()
+        settings := config.Push
+        collectMu.Unlock()
+
+        client := &http.Client{Timeout: settings.Timeout}
+        newPusher := func() *push.Pusher {
+                pusher := push.New(settings.GatewayURL, settings.Job).Client(client)
+                for name, value := range settings.Grouping {
+                        pusher = pusher.Grouping(name, value)
+                }
+                return pusher
+        }
+        ticker := time.NewTicker(settings.Interval)
+        defer ticker.Stop()
+
+        for {
+                select {
+                case <-ticker.C:
+                        if err := pushGateway(newPusher()); err != nil {
+                                slog.Error("push to Pushgateway failed", "url", settings.GatewayURL, "err", err)
+                        }
+                case <-ctx.Done():
+                        if err := newPusher().Delete(); err != nil {
+                                slog.Error("deleting job from Pushgateway failed", "url", settings.GatewayURL, "job", settings.Job, "err", err)
+                        } else {
+                                slog.Info("deleted job from Pushgateway", "url", settings.GatewayURL, "job", settings.Job)
+                        }
+                        return
+                }
+        }
+}
+
+func pushGateway(pusher *push.Pusher) error {
+        collectMu.Lock()
+        collectOnScrape()
+        collectMu.Unlock()
+        mfs, err := exposed.Load().gatherer.Gather()
+        if err != nil {
+                return fmt.Errorf("gather: %w", err)
+        }
+        return pusher.Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+                return mfs, nil
+        })).Push()
+}
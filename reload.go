@@ -0,0 +1,181 @@
+package main
+
+import (
+        "encoding/json"
+        "errors"
+        "io/fs"
+        "log/slog"
+        "net/http"
+        "os"
+        "os/signal"
+        "reflect"
+        "strings"
+        "syscall"
+
+        "gopkg.in/yaml.v3"
+)
+
+// errNotReloadable is returned when reloading a config that was read from
+// stdin or $PROCESSSCOUT_CONFIG, which can't be read again.
+var errNotReloadable = errors.New("config was read from stdin or $" + envConfigVar + " and can't be reloaded")
+
+// reloadResult lists the top-level config keys a reload changed, and the
+// changed keys it ignored because they only apply at startup.
+type reloadResult struct {
+        Changed []string `json:"changed"`
+        Ignored []string `json:"ignored"`
+}
+
+// reloadOnSIGHUP reloads the config from path every time the process gets
+// SIGHUP. It never returns.
+func reloadOnSIGHUP(path string, flags cliFlags) {
+        hup := make(chan os.Signal, 1)
+        signal.Notify(hup, syscall.SIGHUP)
+        for range hup {
+                reloadConfig(path, flags)
+        }
+}
+
+// reloadHandler serves POST /-/reload, which reloads the config like SIGHUP
+// and reports what changed. An invalid config is a 400 and a config that
+// can't be read a 500; either way the running config is kept.
+func reloadHandler(path string, flags cliFlags) http.HandlerFunc {
+        return func(w http.ResponseWriter, r *http.Request) {
+                if r.Method != http.MethodPost {
+                        w.Header().Set("Allow", http.MethodPost)
+                        http.Error(w, "Only POST requests allowed", http.StatusMethodNotAllowed)
+                        return
+                }
+                result, err := reloadConfig(path, flags)
+                if err != nil {
+                        status := http.StatusBadRequest
+                        var pathErr *fs.PathError
+                        if errors.Is(err, errNotReloadable) || errors.As(err, &pathErr) {
+                                status = http.StatusInternalServerError
+                        }
+                        http.Error(w, err.Error(), status)
+                        return
+                }
+                w.Header().Set("Content-Type", "application/json")
+                json.NewEncoder(w).Encode(result)
+        }
+}
+
+// reloadConfig swaps in the config at path and rebuilds the metrics for it.
+// If the file can't be loaded the running config is kept and the error
+// returned. Settings that are only read at startup keep their running
+// values, and command-line flags still override the file.
+func reloadConfig(path string, flags cliFlags) (reloadResult, error) {
+        if path == "-" || path == envConfigPath {
+                slog.Warn("ignoring reload", "err", errNotReloadable)
+                return reloadResult{}, errNotReloadable
+        }
+        next, err := loadConfig(path)
+        if err != nil {
+                slog.Error("config reload failed, keeping the running config", "err", err)
+                return reloadResult{}, err
+        }
+        flags.apply(&next)
+
+        collectMu.Lock()
+        defer collectMu.Unlock()
+        var result reloadResult
+        if next.ListenAddress != config.ListenAddress {
+                result.Ignored = append(result.Ignored, "listen_address")
+                next.ListenAddress = config.ListenAddress
+        }
+        if next.ProcPath != config.ProcPath {
+                result.Ignored = append(result.Ignored, "proc_path")
+                next.ProcPath = config.ProcPath
+        }
+        if next.MetricsPath != config.MetricsPath {
+                result.Ignored = append(result.Ignored, "metrics_path")
+                next.MetricsPath = config.MetricsPath
+        }
+        if next.BasicAuth != config.BasicAuth {
+                result.Ignored = append(result.Ignored, "basic_auth")
+                next.BasicAuth = config.BasicAuth
+        }
+        if next.TLS != config.TLS {
+                result.Ignored = append(result.Ignored, "tls")
+                next.TLS = config.TLS
+        }
+        if next.RemoteWrite != config.RemoteWrite {
+                result.Ignored = append(result.Ignored, "remote_write")
+                next.RemoteWrite = config.RemoteWrite
+        }
+        if !reflect.DeepEqual(next.Push, config.Push) {
+                result.Ignored = append(result.Ignored, "push")
+                next.Push = config.Push
+        }
+        if next.DisableHTTP != config.DisableHTTP {
+                result.Ignored = append(result.Ignored, "disable_http")
+                next.DisableHTTP = config.DisableHTTP
+        }
+        if next.DebugClassify != config.DebugClassify {
+                result.Ignored = append(result.Ignored, "debug_classify")
+                next.DebugClassify = config.DebugClassify
+        }
+        if next.EnableReloadEndpoint != config.EnableReloadEndpoint {
+                result.Ignored = append(result.Ignored, "enable_reload_endpoint")
+                next.EnableReloadEndpoint = config.EnableReloadEndpoint
+        }
+        if next.ScrapeInterval != config.ScrapeInterval {
+                result.Ignored = append(result.Ignored, "scrape_interval")
+                next.ScrapeInterval = config.ScrapeInterval
+        }
+        if next.CollectOnScrape != config.CollectOnScrape {
+                result.Ignored = append(result.Ignored, "collect_on_scrape")
+                next.CollectOnScrape = config.CollectOnScrape
+        }
+        if next.HostCPUSampleInterval != config.HostCPUSampleInterval {
+                result.Ignored = append(result.Ignored, "host_cpu_sample_interval")
+                next.HostCPUSampleInterval = config.HostCPUSampleInterval
+        }
+        if len(result.Ignored) > 0 {
+                slog.Warn("ignoring config changes that need a restart", "keys", strings.Join(result.Ignored, ","))
+        }
+        result.Changed = configChanges(config, next)
+
+        config = next
+        setupLogging(config, flags.quiet)
+        resetProcessState()
+        initMetrics()
+        slog.Info("reloaded config", "path", path, "changed", strings.Join(result.Changed, ","))
+        return result, nil
+}
+
+// configChanges returns the top-level YAML keys whose values differ
+// between old and next. Values are compared in their YAML form so
+// compiled regexes and other unexported state don't count.
+func configChanges(old, next Config) []string {
+        changed := []string{}
+        ov, nv := reflect.ValueOf(old), reflect.ValueOf(next)
+        for i := 0; i < ov.NumField(); i++ {
+                key, _, _ := strings.Cut(ov.Type().Field(i).Tag.Get("yaml"), ",")
+                if key == "" || key == "-" {
+                        continue
+                }
+                a, errA := yaml.Marshal(ov.Field(i).Interface())
+                b, errB := yaml.Marshal(nv.Field(i).Interface())
+                if errA != nil || errB != nil || string(a) != string(b) {
+                        changed = append(changed, key)
+                }
+        }
+        return changed
+}
+
+// resetProcessState drops per-process history whose shape or meaning
+// depends on the config: smoothing windows, leak sample counts, label sets,
+// cached identities and the classifier.
+func resetProcessState() {
+        cpuEWMA = map[int32]*ewmaState{}
+        rssHistory = map[int32]*rssRing{}
+        missedScrapes = map[string]int{}
+        // types and names depend on the rules in the config
+        identityCache = map[int32]identity{}
+
+        classifierMu.Lock()
+        classifierCache = map[int32]classifierEntry{}
+        classifierMu.Unlock()
+}
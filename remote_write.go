@@ -0,0 +1,145 @@
+package main
+
+import (
+        "bytes"
+        "context"
+        "fmt"
+        "io"
+        "log/slog"
+        "math"
+        "net/http"
+        "sort"
+        "strconv"
+        "time"
+
+        "github.com/golang/snappy"
+        dto "github.com/prometheus/client_model/go"
+)
+
+// runRemoteWrite pushes the latest samples to the configured Prometheus
+// remote-write endpoint on a fixed interval, collecting first when
+// collect_on_scrape is set. It returns once ctx is cancelled.
+func runRemoteWrite(ctx context.Context) {
+        // remote_write only applies at startup; copy it rather than read
+        // config, which reloads swap under collectMu
+        collectMu.Lock()
+        settings := config.RemoteWrite
+        collectMu.Unlock()
+
+        client := &http.Client{Timeout: settings.Timeout}
+        ticker := time.NewTicker(settings.Interval)
+        defer ticker.Stop()
+
+        for {
+                select {
+                case <-ctx.Done():
+                        return
+                case <-ticker.C:
+                        if err := pushRemoteWrite(client, settings.URL); err != nil {
+                                slog.Error("remote write failed", "url", settings.URL, "err", err)
+                        }
+                }
+        }
+}
+
+func pushRemoteWrite(client *http.Client, url string) error {
+        collectMu.Lock()
+        collectOnScrape()
+        collectMu.Unlock()
+        mfs, err := exposed.Load().gatherer.Gather()
+        if err != nil {
+                return fmt.Errorf("gather: %w", err)
+        }
+        req := buildWriteRequest(mfs, time.Now())
+        data, err := req.Marshal()
+        if err != nil {
+                return fmt.Errorf("marshal: %w", err)
+        }
+
+        httpReq, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(snappy.Encode(nil, data)))
+        if err != nil {
+                return err
+        }
+        httpReq.Header.Set("Content-Encoding", "snappy")
+        httpReq.Header.Set("Content-Type", "application/x-protobuf")
+        httpReq.Header.Set("User-Agent", "process_scout")
+        httpReq.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+        resp, err := client.Do(httpReq)
+        if err != nil {
+                return err
+        }
+        defer resp.Body.Close()
+        if resp.StatusCode/100 != 2 {
+                body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+                return fmt.Errorf("server returned %s: %s", resp.Status, bytes.TrimSpace(body))
+        }
+        return nil
+}
+
+// buildWriteRequest flattens gathered metric families into remote-write time
+// series, expanding histograms and summaries into their component series.
+func buildWriteRequest(mfs []*dto.MetricFamily, now time.Time) *WriteRequest {
+        ts := now.UnixMilli()
+        req := &WriteRequest{}
+
+        add := func(name string, m *dto.Metric, value float64, extra ...Label) {
+                labels := make([]Label, 0, len(m.GetLabel())+len(extra)+1)
+                labels = append(labels, Label{Name: "__name__", Value: name})
+                for _, lp := range m.GetLabel() {
+                        labels = append(labels, Label{Name: lp.GetName(), Value: lp.GetValue()})
+                }
+                labels = append(labels, extra...)
+                sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+                sampleTs := ts
+                if m.GetTimestampMs() != 0 {
+                        sampleTs = m.GetTimestampMs()
+                }
+                req.Timeseries = append(req.Timeseries, TimeSeries{
+                        Labels:  labels,
+                        Samples: []Sample{{Value: value, Timestamp: sampleTs}},
+                })
+        }
+
+        for _, mf := range mfs {
+                name := mf.GetName()
+                for _, m := range mf.GetMetric() {
+                        switch mf.GetType() {
+                        case dto.MetricType_GAUGE:
+                                add(name, m, m.GetGauge().GetValue())
+                        case dto.MetricType_COUNTER:
+                                add(name, m, m.GetCounter().GetValue())
+                        case dto.MetricType_UNTYPED:
+                                add(name, m, m.GetUntyped().GetValue())
+                        case dto.MetricType_SUMMARY:
+                                s := m.GetSummary()
+                                for _, q := range s.GetQuantile() {
+                                        add(name, m, q.GetValue(), Label{Name: "quantile", Value: formatFloat(q.GetQuantile())})
+                                }
+                                add(name+"_sum", m, s.GetSampleSum())
+                                add(name+"_count", m, float64(s.GetSampleCount()))
+                        case dto.MetricType_HISTOGRAM:
+                                h := m.GetHistogram()
+                                sawInf := false
+                                for _, b := range h.GetBucket() {
+                                        sawInf = sawInf || math.IsInf(b.GetUpperBound(), +1)
+                                        add(name+"_bucket", m, float64(b.GetCumulativeCount()), Label{Name: "le", Value: formatFloat(b.GetUpperBound())})
+                                }
+                                if !sawInf {
+                                        add(name+"_bucket", m, float64(h.GetSampleCount()), Label{Name: "le", Value: "+Inf"})
+                                }
+                                add(name+"_sum", m, h.GetSampleSum())
+                                add(name+"_count", m, float64(h.GetSampleCount()))
+                        }
+                }
+        }
+        return req
+}
+
+func formatFloat(f float64) string {
+        if math.IsInf(f, +1) {
+                return "+Inf"
+        }
+        return strconv.FormatFloat(f, 'g', -1, 64)
+}
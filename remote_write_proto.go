@@ -0,0 +1,89 @@
+package main
+
+import (
+        "encoding/binary"
+        "math"
+)
+
+// The remote-write protobuf messages, hand-encoded so remote_write doesn't
+// pull in the Prometheus server module for four message types. Field
+// numbers follow prometheus/prompb (types.proto, remote.proto); metadata
+// isn't sent.
+
+// WriteRequest is the body of a remote-write request.
+type WriteRequest struct {
+        Timeseries []TimeSeries
+}
+
+// TimeSeries is one series: its sorted labels and samples.
+type TimeSeries struct {
+        Labels  []Label
+        Samples []Sample
+}
+
+// Label is one label name and value.
+type Label struct {
+        Name  string
+        Value string
+}
+
+// Sample is a value at a timestamp in milliseconds.
+type Sample struct {
+        Value     float64
+        Timestamp int64
+}
+
+// protobuf wire types
+const (
+        wireVarint  = 0
+        wireFixed64 = 1
+        wireBytes   = 2
+)
+
+// Marshal encodes r in the protobuf wire format.
+func (r *WriteRequest) Marshal() ([]byte, error) {
+        var b []byte
+        for _, ts := range r.Timeseries {
+                b = appendMessage(b, 1, ts.marshal())
+        }
+        return b, nil
+}
+
+func (ts TimeSeries) marshal() []byte {
+        var b []byte
+        for _, l := range ts.Labels {
+                var lb []byte
+                lb = appendString(lb, 1, l.Name)
+                lb = appendString(lb, 2, l.Value)
+                b = appendMessage(b, 1, lb)
+        }
+        for _, s := range ts.Samples {
+                var sb []byte
+                // proto3 leaves out zero values
+                if s.Value != 0 || math.Signbit(s.Value) {
+                        sb = binary.AppendUvarint(sb, 1<<3|wireFixed64)
+                        sb = binary.LittleEndian.AppendUint64(sb, math.Float64bits(s.Value))
+                }
+                if s.Timestamp != 0 {
+                        sb = binary.AppendUvarint(sb, 2<<3|wireVarint)
+                        sb = binary.AppendUvarint(sb, uint64(s.Timestamp))
+                }
+                b = appendMessage(b, 2, sb)
+        }
+        return b
+}
+
+func appendString(b []byte, field uint64, s string) []byte {
+        if s == "" {
+                return b
+        }
+        b = binary.AppendUvarint(b, field<<3|wireBytes)
+        b = binary.AppendUvarint(b, uint64(len(s)))
+        return append(b, s...)
+}
+
+func appendMessage(b []byte, field uint64, msg []byte) []byte {
+        b = binary.AppendUvarint(b, field<<3|wireBytes)
+        b = binary.AppendUvarint(b, uint64(len(msg)))
+        return append(b, msg...)
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+        "errors"
+        "io/fs"
+
+        "github.com/shirou/gopsutil/v4/cpu"
+        "github.com/shirou/gopsutil/v4/process"
+)
+
+// listProcesses enumerates the running processes. Collection reads each
+// one only through sourceProcess, so tests replace this with fakes.
+var listProcesses = func() ([]sourceProcess, error) {
+        procs, err := process.Processes()
+        if err != nil {
+                return nil, err
+        }
+        live := make([]sourceProcess, len(procs))
+        for i, p := range procs {
+                live[i] = procfsProcess{Process: p}
+        }
+        return live, nil
+}
+
+// lookupProcess returns the process with the given PID, for the parent_name
+// label. Like listProcesses it is replaced in tests.
+var lookupProcess = func(pid int32) (sourceProcess, error) {
+        p, err := process.NewProcess(pid)
+        if err != nil {
+                return nil, err
+        }
+        return procfsProcess{Process: p}, nil
+}
+
+// processInfo is what classification and naming read from a process, so
+// getProcessType and getProcessName can be tested with fakes instead of
+// real /proc entries.
+type processInfo interface {
+        Name() (string, error)
+        Cmdline() (string, error)
+        CmdlineSlice() ([]string, error)
+        CreateTime() (int64, error)
+        pid() int32
+        // contents of /proc/<pid>/cgroup, "" if unreadable
+        cgroup() string
+}
+
+// filterSubject is what the filters read from a process: a live one during
+// collection, or the snapshot /debug/classify takes.
+type filterSubject interface {
+        processInfo
+        Username() (string, error)
+        Ppid() (int32, error)
+}
+
+// sourceProcess is everything collection reads from a listed process. The
+// method set is gopsutil's, which procfsProcess provides for live ones.
+type sourceProcess interface {
+        filterSubject
+        Tgid() (int32, error)
+        Exe() (string, error)
+        Cwd() (string, error)
+        Terminal() (string, error)
+        Environ() ([]string, error)
+        Times() (*cpu.TimesStat, error)
+        CPUPercent() (float64, error)
+        MemoryInfo() (*process.MemoryInfoStat, error)
+        MemoryInfoEx() (*process.MemoryInfoExStat, error)
+        NumFDs() (int32, error)
+        NumThreads() (int32, error)
+        NumCtxSwitches() (*process.NumCtxSwitchesStat, error)
+        PageFaults() (*process.PageFaultsStat, error)
+        Rlimit() ([]process.RlimitStat, error)
+        Threads() (map[int32]*cpu.TimesStat, error)
+        // like cgroup, but failing if the process has exited (see
+        // processGone)
+        readCgroup() (string, error)
+}
+
+// procfsProcess is a live process, read through gopsutil and proc_path.
+type procfsProcess struct {
+        *process.Process
+}
+
+func (p procfsProcess) pid() int32 { return p.Pid }
+
+func (p procfsProcess) cgroup() string {
+        cgroup, _ := readCgroup(p.Pid)
+        return cgroup
+}
+
+func (p procfsProcess) readCgroup() (string, error) { return readCgroup(p.Pid) }
+
+// cgroupRead is a sourceProcess whose cgroup was read once up front, so
+// the type and the name don't each read it.
+type cgroupRead struct {
+        sourceProcess
+        cgroupData string
+}
+
+func (p cgroupRead) cgroup() string { return p.cgroupData }
+
+// readSourceCgroup wraps p, reading its cgroup once up front. It fails if p
+// has exited.
+func readSourceCgroup(p sourceProcess) (cgroupRead, error) {
+        cgroup, err := p.readCgroup()
+        if processGone(err) {
+                return cgroupRead{}, err
+        }
+        return cgroupRead{sourceProcess: p, cgroupData: cgroup}, nil
+}
+
+// processGone reports whether err is from reading a /proc entry that no
+// longer exists: the process exited after it was listed. That is normal
+// churn on a busy host, not a collection error.
+func processGone(err error) bool {
+        return errors.Is(err, fs.ErrNotExist)
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+        "crypto/tls"
+        "fmt"
+        "log/slog"
+        "os"
+        "sync"
+        "time"
+)
+
+// certReloader serves the TLS certificate from disk and reloads it when the
+// cert or key file changes, so rotated certificates are picked up without a
+// restart. If a reload fails the previous certificate keeps being served.
+type certReloader struct {
+        certFile, keyFile string
+
+        mu      sync.Mutex
+        cert    *tls.Certificate
+        certMod time.Time
+        keyMod  time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+        r := &certReloader{certFile: certFile, keyFile: keyFile}
+        if err := r.maybeReload(); err != nil {
+                return nil, err
+        }
+        return r, nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+        if err := r.maybeReload(); err != nil {
+                slog.Warn("keeping previous TLS certificate", "err", err)
+        }
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        return r.cert, nil
+}
+
+// maybeReload loads the key pair if either file's mtime differs from the
+// one the cached certificate was loaded from.
+func (r *certReloader) maybeReload() error {
+        certInfo, err := os.Stat(r.certFile)
+        if err != nil {
+                return err
+        }
+        keyInfo, err := os.Stat(r.keyFile)
+        if err != nil {
+                return err
+        }
+
+        r.mu.Lock()
+        defer r.mu.Unlock()
+        if r.cert != nil && certInfo.ModTime().Equal(r.certMod) && keyInfo.ModTime().Equal(r.keyMod) {
+                return nil
+        }
+        cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+        if err != nil {
+                return fmt.Errorf("loading %s / %s: %w", r.certFile, r.keyFile, err)
+        }
+        if r.cert != nil {
+                slog.Info("reloaded TLS certificate", "file", r.certFile)
+        }
+        r.cert = &cert
+        r.certMod = certInfo.ModTime()
+        r.keyMod = keyInfo.ModTime()
+        return nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+        "strings"
+        "sync"
+
+        "github.com/prometheus/client_golang/prometheus"
+        dto "github.com/prometheus/client_model/go"
+)
+
+// unchangedGatherer drops gauge series whose value is the same as in the
+// previous exposition it produced. Counters, histograms and summaries are
+// always passed through.
+//
+// This deliberately breaks Prometheus staleness handling: a series that
+// stops changing disappears from the output and will be marked stale by a
+// regular Prometheus server. It is only meant for consumers that keep the
+// last seen value themselves.
+type unchangedGatherer struct {
+        g prometheus.Gatherer
+
+        mu   sync.Mutex
+        last map[string]float64
+}
+
+func newUnchangedGatherer(g prometheus.Gatherer) *unchangedGatherer {
+        return &unchangedGatherer{g: g, last: map[string]float64{}}
+}
+
+func (u *unchangedGatherer) Gather() ([]*dto.MetricFamily, error) {
+        mfs, err := u.g.Gather()
+        if err != nil {
+                return mfs, err
+        }
+
+        u.mu.Lock()
+        defer u.mu.Unlock()
+        // rebuilt every time so a series that vanished and came back with
+        // its old value is sent again
+        current := make(map[string]float64, len(u.last))
+        kept := mfs[:0]
+        for _, mf := range mfs {
+                if mf.GetType() != dto.MetricType_GAUGE {
+                        kept = append(kept, mf)
+                        continue
+                }
+                changed := mf.Metric[:0]
+                for _, m := range mf.GetMetric() {
+                        key := gaugeSeriesKey(mf.GetName(), m)
+                        value := m.GetGauge().GetValue()
+                        current[key] = value
+                        if prev, ok := u.last[key]; ok && prev == value {
+                                continue
+                        }
+                        changed = append(changed, m)
+                }
+                if len(changed) > 0 {
+                        mf.Metric = changed
+                        kept = append(kept, mf)
+                }
+        }
+        u.last = current
+        return kept, nil
+}
+
+func gaugeSeriesKey(name string, m *dto.Metric) string {
+        var b strings.Builder
+        b.WriteString(name)
+        for _, lp := range m.GetLabel() {
+                b.WriteByte(0xff)
+                b.WriteString(lp.GetName())
+                b.WriteByte('=')
+                b.WriteString(lp.GetValue())
+        }
+        return b.String()
+}